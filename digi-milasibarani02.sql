@@ -33,3 +33,426 @@ CREATE TABLE public."transaction" (
 	CONSTRAINT transaction_pk PRIMARY KEY (transaction_id)
 );
 
+
+-- Double-entry ledger
+
+ALTER TABLE public.accounts ADD system_code varchar NULL;
+ALTER TABLE public.accounts ADD CONSTRAINT accounts_system_code_unique UNIQUE (system_code);
+
+INSERT INTO public.accounts ("name", system_code) VALUES
+	('System cash_in', 'cash_in'),
+	('System fees', 'fees');
+
+CREATE TABLE public.journal_entries (
+	journal_entry_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	entry_type varchar NOT NULL,
+	description varchar NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT journal_entries_pk PRIMARY KEY (journal_entry_id)
+);
+
+-- A positive amount credits the account, a negative amount debits it.
+-- The postings of a journal entry always sum to zero.
+CREATE TABLE public.postings (
+	posting_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	journal_entry_id int8 NOT NULL,
+	account_id int8 NOT NULL,
+	amount int8 NOT NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT postings_pk PRIMARY KEY (posting_id),
+	CONSTRAINT fk_posting_journal_entry FOREIGN KEY (journal_entry_id) REFERENCES public.journal_entries(journal_entry_id),
+	CONSTRAINT fk_posting_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id)
+);
+CREATE INDEX postings_account_id_idx ON public.postings (account_id);
+
+ALTER TABLE public."transaction" ADD transaction_type varchar NULL;
+ALTER TABLE public."transaction" ADD journal_entry_id int8 NULL;
+ALTER TABLE public."transaction" ADD CONSTRAINT fk_transaction_journal_entry FOREIGN KEY (journal_entry_id) REFERENCES public.journal_entries(journal_entry_id);
+
+-- Move balances that existed before the ledger into opening balance entries against cash_in
+WITH opening AS (
+	INSERT INTO public.journal_entries (entry_type, description)
+	SELECT 'opening_balance', 'Opening balance of account ' || account_id
+	FROM public.accounts
+	WHERE balance <> 0 AND system_code IS NULL
+	RETURNING journal_entry_id, description
+)
+INSERT INTO public.postings (journal_entry_id, account_id, amount)
+SELECT o.journal_entry_id, a.account_id, a.balance
+FROM opening o
+JOIN public.accounts a ON o.description = 'Opening balance of account ' || a.account_id
+UNION ALL
+SELECT o.journal_entry_id, c.account_id, -a.balance
+FROM opening o
+JOIN public.accounts a ON o.description = 'Opening balance of account ' || a.account_id
+CROSS JOIN public.accounts c
+WHERE c.system_code = 'cash_in';
+
+UPDATE public.accounts c SET balance = -(SELECT COALESCE(SUM(balance), 0) FROM public.accounts WHERE system_code IS NULL)
+WHERE c.system_code = 'cash_in';
+
+-- Balances derived from postings, must always equal accounts.balance
+CREATE VIEW public.ledger_balances AS
+SELECT a.account_id, a.balance AS cached_balance, COALESCE(SUM(p.amount), 0) AS ledger_balance
+FROM public.accounts a
+LEFT JOIN public.postings p ON p.account_id = a.account_id
+GROUP BY a.account_id, a.balance;
+
+-- Idempotency keys for money-moving endpoints
+
+CREATE TABLE public.idempotency_keys (
+	idempotency_key_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	account_id int8 NOT NULL,
+	idempotency_key varchar NOT NULL,
+	request_hash varchar NOT NULL,
+	status_code int4 DEFAULT 0 NOT NULL,
+	response_body bytea NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT idempotency_keys_pk PRIMARY KEY (idempotency_key_id),
+	CONSTRAINT idempotency_keys_unique UNIQUE (account_id, idempotency_key)
+);
+
+-- Cursor pagination of transaction history
+
+CREATE INDEX transaction_account_date_idx ON public."transaction" (account_id, transaction_date DESC, transaction_id DESC);
+
+-- Monthly statements, every ledger posting on a user account has a matching transaction row
+
+INSERT INTO public."transaction" (account_id, amount, transaction_date, transaction_type, journal_entry_id)
+SELECT p.account_id, p.amount, p.created_at, 'opening_balance', p.journal_entry_id
+FROM public.postings p
+JOIN public.journal_entries j ON j.journal_entry_id = p.journal_entry_id
+JOIN public.accounts a ON a.account_id = p.account_id
+WHERE j.entry_type = 'opening_balance' AND a.system_code IS NULL;
+
+-- Referral program
+
+ALTER TABLE public.accounts ADD referral_code varchar NULL;
+ALTER TABLE public.accounts ADD CONSTRAINT accounts_referral_code_unique UNIQUE (referral_code);
+
+INSERT INTO public.accounts ("name", system_code) VALUES ('System referrals', 'referrals');
+
+CREATE TABLE public.referral_rewards (
+	referral_reward_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	referrer_account_id int8 NOT NULL,
+	referee_account_id int8 NOT NULL,
+	amount int8 NOT NULL,
+	journal_entry_id int8 NOT NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT referral_rewards_pk PRIMARY KEY (referral_reward_id),
+	CONSTRAINT referral_rewards_referee_unique UNIQUE (referee_account_id),
+	CONSTRAINT fk_referral_reward_referrer FOREIGN KEY (referrer_account_id) REFERENCES public.accounts(account_id),
+	CONSTRAINT fk_referral_reward_referee FOREIGN KEY (referee_account_id) REFERENCES public.accounts(account_id),
+	CONSTRAINT fk_referral_reward_journal_entry FOREIGN KEY (journal_entry_id) REFERENCES public.journal_entries(journal_entry_id)
+);
+
+-- Monthly budgets per transaction category
+
+CREATE TABLE public.category_budgets (
+	category_budget_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	account_id int8 NOT NULL,
+	transaction_category_id int4 NOT NULL,
+	amount int8 NOT NULL,
+	CONSTRAINT category_budgets_pk PRIMARY KEY (category_budget_id),
+	CONSTRAINT category_budgets_unique UNIQUE (account_id, transaction_category_id),
+	CONSTRAINT fk_category_budget_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id),
+	CONSTRAINT fk_category_budget_category FOREIGN KEY (transaction_category_id) REFERENCES public.transaction_categories(transaction_category_id) ON DELETE CASCADE
+);
+
+-- Scheduled and recurring transfers
+
+CREATE TABLE public.standing_orders (
+	standing_order_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	account_id int8 NOT NULL,
+	target_account_id int8 NOT NULL,
+	amount int8 NOT NULL,
+	schedule varchar NOT NULL,
+	day_of_month int4 NULL,
+	next_run_at timestamptz NOT NULL,
+	retry_at timestamptz NULL,
+	status varchar NOT NULL,
+	retry_count int4 DEFAULT 0 NOT NULL,
+	last_error varchar NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT standing_orders_pk PRIMARY KEY (standing_order_id),
+	CONSTRAINT fk_standing_order_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id),
+	CONSTRAINT fk_standing_order_target FOREIGN KEY (target_account_id) REFERENCES public.accounts(account_id)
+);
+CREATE INDEX standing_orders_due_idx ON public.standing_orders (COALESCE(retry_at, next_run_at)) WHERE status = 'active';
+
+CREATE TABLE public.standing_order_runs (
+	standing_order_run_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	standing_order_id int8 NOT NULL,
+	scheduled_at timestamptz NOT NULL,
+	attempt int4 NOT NULL,
+	status varchar NOT NULL,
+	error varchar NULL,
+	journal_entry_id int8 NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT standing_order_runs_pk PRIMARY KEY (standing_order_run_id),
+	CONSTRAINT fk_standing_order_run_order FOREIGN KEY (standing_order_id) REFERENCES public.standing_orders(standing_order_id)
+);
+
+-- Refresh tokens and access token revocation
+
+CREATE TABLE public.refresh_tokens (
+	refresh_token_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	auth_id int8 NOT NULL,
+	family_id varchar NOT NULL,
+	token_hash varchar NOT NULL,
+	expires_at timestamptz NOT NULL,
+	revoked_at timestamptz NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT refresh_tokens_pk PRIMARY KEY (refresh_token_id),
+	CONSTRAINT refresh_tokens_hash_unique UNIQUE (token_hash)
+);
+CREATE INDEX refresh_tokens_family_idx ON public.refresh_tokens (family_id);
+
+CREATE TABLE public.revoked_tokens (
+	jti varchar NOT NULL,
+	expires_at timestamptz NOT NULL,
+	CONSTRAINT revoked_tokens_pk PRIMARY KEY (jti)
+);
+
+-- Roles, promote the first admin by hand:
+-- UPDATE public.auths SET "role" = 'admin' WHERE username = '...';
+
+ALTER TABLE public.auths ADD "role" varchar DEFAULT 'user' NOT NULL;
+ALTER TABLE public.auths ADD CONSTRAINT auths_role_check CHECK ("role" IN ('user', 'admin', 'support'));
+
+-- Self-service registration and audited credential changes
+
+CREATE TABLE public.credential_audits (
+	credential_audit_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	auth_id int8 NOT NULL,
+	actor_auth_id int8 NOT NULL,
+	"action" varchar NOT NULL,
+	reason varchar NOT NULL,
+	ip varchar NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT credential_audits_pk PRIMARY KEY (credential_audit_id)
+);
+
+-- Transaction categories owned by an account, NULL owner for the global defaults
+
+ALTER TABLE public.transaction_categories ADD account_id int8 NULL;
+ALTER TABLE public.transaction_categories ADD CONSTRAINT fk_transaction_category_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id);
+CREATE INDEX transaction_categories_account_idx ON public.transaction_categories (account_id);
+
+-- Multi-currency wallets, amounts are in the smallest unit of the currency
+
+ALTER TABLE public.accounts ADD currency varchar(3) DEFAULT 'IDR' NOT NULL;
+ALTER TABLE public.accounts DROP CONSTRAINT accounts_system_code_unique;
+ALTER TABLE public.accounts ADD CONSTRAINT accounts_system_code_unique UNIQUE (system_code, currency);
+
+ALTER TABLE public.postings ADD currency varchar(3) DEFAULT 'IDR' NOT NULL;
+
+ALTER TABLE public."transaction" ADD currency varchar(3) NULL;
+ALTER TABLE public."transaction" ADD fx_rate numeric(24, 12) NULL;
+ALTER TABLE public."transaction" ADD counter_amount int8 NULL;
+ALTER TABLE public."transaction" ADD counter_currency varchar(3) NULL;
+UPDATE public."transaction" SET currency = 'IDR' WHERE journal_entry_id IS NOT NULL;
+
+-- quote amount = base amount * rate
+CREATE TABLE public.fx_rates (
+	fx_rate_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	base_currency varchar(3) NOT NULL,
+	quote_currency varchar(3) NOT NULL,
+	rate numeric(24, 12) NOT NULL,
+	updated_by int8 NOT NULL,
+	updated_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT fx_rates_pk PRIMARY KEY (fx_rate_id),
+	CONSTRAINT fx_rates_pair_unique UNIQUE (base_currency, quote_currency),
+	CONSTRAINT fx_rates_rate_check CHECK (rate > 0)
+);
+
+-- Multiple wallets per login
+
+ALTER TABLE public.accounts ADD owner_auth_id int8 NULL;
+CREATE INDEX accounts_owner_auth_idx ON public.accounts (owner_auth_id);
+UPDATE public.accounts a SET owner_auth_id = au.auth_id FROM public.auths au WHERE au.account_id = a.account_id;
+
+-- Reversals and refunds, linked to the transaction they compensate
+
+ALTER TABLE public."transaction" ADD reversal_of_id int8 NULL;
+ALTER TABLE public."transaction" ADD CONSTRAINT fk_transaction_reversal_of FOREIGN KEY (reversal_of_id) REFERENCES public."transaction"(transaction_id);
+CREATE INDEX transaction_reversal_of_idx ON public."transaction" (reversal_of_id);
+
+-- Holds, two-phase transfers
+
+ALTER TABLE public.accounts ADD held_balance int8 DEFAULT 0 NOT NULL;
+
+CREATE TABLE public.holds (
+	hold_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	account_id int8 NOT NULL,
+	target_account_id int8 NOT NULL,
+	amount int8 NOT NULL,
+	fee int8 DEFAULT 0 NOT NULL,
+	captured_amount int8 DEFAULT 0 NOT NULL,
+	status varchar NOT NULL,
+	journal_entry_id int8 NULL,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	updated_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT holds_pk PRIMARY KEY (hold_id),
+	CONSTRAINT fk_hold_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id),
+	CONSTRAINT fk_hold_target FOREIGN KEY (target_account_id) REFERENCES public.accounts(account_id),
+	CONSTRAINT fk_hold_journal_entry FOREIGN KEY (journal_entry_id) REFERENCES public.journal_entries(journal_entry_id)
+);
+CREATE INDEX holds_expiry_idx ON public.holds (expires_at) WHERE status = 'authorized';
+
+-- Topup and transfer limits, NULL account_id is the global default and NULL fields are unlimited.
+-- Amounts are in currency, an account only uses the limits of its own currency.
+
+CREATE TABLE public.account_limits (
+	account_limit_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	account_id int8 NULL,
+	kind varchar NOT NULL,
+	currency varchar(3) DEFAULT 'IDR' NOT NULL,
+	per_transaction_max int8 NULL,
+	daily_count int8 NULL,
+	daily_amount int8 NULL,
+	monthly_count int8 NULL,
+	monthly_amount int8 NULL,
+	CONSTRAINT account_limits_pk PRIMARY KEY (account_limit_id),
+	CONSTRAINT account_limits_kind_check CHECK (kind IN ('topup', 'transfer')),
+	CONSTRAINT fk_account_limit_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id)
+);
+CREATE UNIQUE INDEX account_limits_account_kind_unique ON public.account_limits (COALESCE(account_id, 0), kind, currency);
+
+-- Fraud screening, operations blocked or held for review by the rules in the FRAUD_RULES file
+
+CREATE TABLE public.fraud_reviews (
+	fraud_review_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	account_id int8 NOT NULL,
+	auth_id int8 NOT NULL,
+	operation varchar NOT NULL,
+	amount int8 NOT NULL,
+	target_account_id int8 NULL,
+	payload bytea NOT NULL,
+	rules varchar NOT NULL,
+	status varchar NOT NULL,
+	reviewed_by int8 NULL,
+	review_note varchar NULL,
+	transaction_id int8 NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	reviewed_at timestamptz NULL,
+	CONSTRAINT fraud_reviews_pk PRIMARY KEY (fraud_review_id),
+	CONSTRAINT fk_fraud_review_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id),
+	CONSTRAINT fk_fraud_review_transaction FOREIGN KEY (transaction_id) REFERENCES public."transaction"(transaction_id)
+);
+CREATE INDEX fraud_reviews_status_idx ON public.fraud_reviews (status, fraud_review_id);
+
+-- Outgoing webhooks, events are written to the outbox in the transaction that moves the money
+
+CREATE TABLE public.webhook_subscriptions (
+	webhook_subscription_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	url varchar NOT NULL,
+	secret varchar NOT NULL,
+	event_types varchar NOT NULL,
+	account_id int8 NULL,
+	active bool DEFAULT true NOT NULL,
+	created_by int8 NOT NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT webhook_subscriptions_pk PRIMARY KEY (webhook_subscription_id),
+	CONSTRAINT fk_webhook_subscription_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id)
+);
+
+CREATE TABLE public.webhook_events (
+	webhook_event_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	event_type varchar NOT NULL,
+	account_id int8 NOT NULL,
+	payload bytea NOT NULL,
+	dispatched_at timestamptz NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT webhook_events_pk PRIMARY KEY (webhook_event_id)
+);
+CREATE INDEX webhook_events_undispatched_idx ON public.webhook_events (webhook_event_id) WHERE dispatched_at IS NULL;
+
+CREATE TABLE public.webhook_deliveries (
+	webhook_delivery_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	webhook_event_id int8 NOT NULL,
+	webhook_subscription_id int8 NOT NULL,
+	status varchar NOT NULL,
+	attempts int4 DEFAULT 0 NOT NULL,
+	next_attempt_at timestamptz NOT NULL,
+	delivered_at timestamptz NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT webhook_deliveries_pk PRIMARY KEY (webhook_delivery_id),
+	CONSTRAINT fk_webhook_delivery_event FOREIGN KEY (webhook_event_id) REFERENCES public.webhook_events(webhook_event_id),
+	CONSTRAINT fk_webhook_delivery_subscription FOREIGN KEY (webhook_subscription_id) REFERENCES public.webhook_subscriptions(webhook_subscription_id)
+);
+CREATE INDEX webhook_deliveries_due_idx ON public.webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX webhook_deliveries_subscription_idx ON public.webhook_deliveries (webhook_subscription_id, webhook_delivery_id);
+
+CREATE TABLE public.webhook_attempts (
+	webhook_attempt_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	webhook_delivery_id int8 NOT NULL,
+	status_code int4 NULL,
+	error varchar NULL,
+	duration_ms int8 NOT NULL,
+	attempted_at timestamptz NOT NULL,
+	CONSTRAINT webhook_attempts_pk PRIMARY KEY (webhook_attempt_id),
+	CONSTRAINT fk_webhook_attempt_delivery FOREIGN KEY (webhook_delivery_id) REFERENCES public.webhook_deliveries(webhook_delivery_id)
+);
+CREATE INDEX webhook_attempts_delivery_idx ON public.webhook_attempts (webhook_delivery_id);
+
+-- Audit log of every mutating request, append-only
+
+CREATE TABLE public.audit_logs (
+	audit_log_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	request_id varchar NOT NULL,
+	auth_id int8 NULL,
+	"role" varchar NULL,
+	"action" varchar NOT NULL,
+	entity varchar NULL,
+	entity_id varchar NULL,
+	"method" varchar NOT NULL,
+	"path" varchar NOT NULL,
+	status_code int4 NOT NULL,
+	ip varchar NOT NULL,
+	"before" jsonb NULL,
+	"after" jsonb NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT audit_logs_pk PRIMARY KEY (audit_log_id)
+);
+CREATE INDEX audit_logs_auth_idx ON public.audit_logs (auth_id, audit_log_id);
+CREATE INDEX audit_logs_entity_idx ON public.audit_logs (entity, entity_id, audit_log_id);
+CREATE INDEX audit_logs_request_idx ON public.audit_logs (request_id);
+
+CREATE FUNCTION public.audit_logs_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_logs is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_logs_no_update BEFORE UPDATE OR DELETE ON public.audit_logs
+	FOR EACH ROW EXECUTE FUNCTION public.audit_logs_append_only();
+CREATE TRIGGER audit_logs_no_truncate BEFORE TRUNCATE ON public.audit_logs
+	FOR EACH STATEMENT EXECUTE FUNCTION public.audit_logs_append_only();
+
+-- Account closure, closed accounts are soft deleted and keep their history
+
+ALTER TABLE public.accounts ADD status varchar DEFAULT 'active' NOT NULL;
+ALTER TABLE public.accounts ADD closed_at timestamptz NULL;
+ALTER TABLE public.accounts ADD deleted_at timestamptz NULL;
+ALTER TABLE public.accounts ADD CONSTRAINT accounts_status_check CHECK (status IN ('active', 'closing', 'closed'));
+CREATE INDEX accounts_deleted_at_idx ON public.accounts (deleted_at);
+
+-- Frozen and suspended accounts, with the reason of every status change
+
+ALTER TABLE public.accounts DROP CONSTRAINT accounts_status_check;
+ALTER TABLE public.accounts ADD CONSTRAINT accounts_status_check CHECK (status IN ('active', 'closing', 'closed', 'frozen', 'suspended'));
+
+CREATE TABLE public.account_status_changes (
+	account_status_change_id int8 GENERATED ALWAYS AS IDENTITY NOT NULL,
+	account_id int8 NOT NULL,
+	from_status varchar NOT NULL,
+	to_status varchar NOT NULL,
+	reason varchar NOT NULL,
+	changed_by int8 NOT NULL,
+	created_at timestamptz DEFAULT now() NOT NULL,
+	CONSTRAINT account_status_changes_pk PRIMARY KEY (account_status_change_id),
+	CONSTRAINT fk_account_status_change_account FOREIGN KEY (account_id) REFERENCES public.accounts(account_id)
+);
+CREATE INDEX account_status_changes_account_idx ON public.account_status_changes (account_id, account_status_change_id);
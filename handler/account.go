@@ -1,13 +1,13 @@
 package handler
 
 import (
-	"task-golang-db/model"
+	"bytes"
 	"net/http"
+	"task-golang-db/model"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
-	
 )
 
 type AccountInterface interface {
@@ -21,20 +21,47 @@ type AccountInterface interface {
 	Balance(c *gin.Context)
 	My(*gin.Context)
 	Mutation(*gin.Context)
+	Statement(*gin.Context)
+	Referrals(*gin.Context)
+	CreateWallet(*gin.Context)
+	MoveBetweenWallets(*gin.Context)
+	Close(*gin.Context)
+	Reopen(*gin.Context)
+	SetStatus(*gin.Context)
+	StatusHistory(*gin.Context)
+}
+
+// AccountConfig holds the amounts charged or paid out by the account handlers
+type AccountConfig struct {
+	TransferFee   int64 // charged to the sender of a transfer, in the sender's currency
+	ReferralBonus int64 // paid to both referrer and referee on the referee's first topup, in the default currency
+
+	ReopenGracePeriod time.Duration // how long after closure an admin can reopen an account
+	FrozenAllowsTopup bool          // whether frozen accounts still accept topups
 }
 
 type accountImplement struct {
-	db *gorm.DB
+	db     *gorm.DB
+	config AccountConfig
+	fraud  *FraudScreener
 }
 
-func NewAccount(db *gorm.DB) AccountInterface {
+func NewAccount(db *gorm.DB, config AccountConfig, fraud *FraudScreener) AccountInterface {
 	return &accountImplement{
-		db: db,
+		db:     db,
+		config: config,
+		fraud:  fraud,
 	}
 }
 
+type accountCreatePayload struct {
+	Name         string `json:"name"`
+	ReferralCode string `json:"referral_code"` // code of the referring account, optional
+	Currency     string `json:"currency"`      // defaults to IDR
+}
+
 func (a *accountImplement) Create(c *gin.Context) {
-	payload := model.Account{}
+	payload := accountCreatePayload{}
 
 	// bind JSON Request to payload
 	err := c.BindJSON(&payload)
@@ -46,18 +73,17 @@ func (a *accountImplement) Create(c *gin.Context) {
 	}
 
 	// Create data
-	result := a.db.Create(&payload)
-	if result.Error != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"error": result.Error.Error(),
-		})
+	account, err := createAccount(a.db, payload.Name, payload.ReferralCode, payload.Currency)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
+	auditChange(c, "account.create", "account", account.AccountID, nil, snapshot(account))
 
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Create success",
-		"data":    payload,
+		"data":    account,
 	})
 }
 
@@ -120,8 +146,10 @@ func (a *accountImplement) Update(c *gin.Context) {
 	}
 
 	// Update data
+	before := snapshot(account)
 	account.Name = payload.Name
 	a.db.Save(account)
+	auditChange(c, "account.update", "account", account.AccountID, before, snapshot(account))
 
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
@@ -129,19 +157,12 @@ func (a *accountImplement) Update(c *gin.Context) {
 	})
 }
 
-func (a *accountImplement) Delete(c *gin.Context) {
-	// get id from url account/delete/5, 5 will be the id
-	id := c.Param("id")
+func (a *accountImplement) List(c *gin.Context) {
+	// Prepare empty result
+	var accounts []model.Account
 
-	// Find first data based on id and delete it
-	if err := a.db.Where("account_id = ?", id).Delete(&model.Account{}).Error; err != nil {
-		// No data found and deleted
-		if err == gorm.ErrRecordNotFound {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-				"error": "Not found",
-			})
-			return
-		}
+	// Find and get all accounts data and put to &accounts
+	if err := a.db.Find(&accounts).Error; err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
@@ -150,20 +171,20 @@ func (a *accountImplement) Delete(c *gin.Context) {
 
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Delete success",
-		"data": map[string]string{
-			"account_id": id,
-		},
+		"data": accounts,
 	})
 }
 
-func (a *accountImplement) List(c *gin.Context) {
-	// Prepare empty result
-	var accounts []model.Account
-
-	// Find and get all accounts data and put to &accounts
-	if err := a.db.Find(&accounts).Error; err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+func (a *accountImplement) My(c *gin.Context) {
+	accounts := []model.Account{}
+	// get auth_id from middleware auth
+	authID := c.GetInt64("auth_id")
+
+	// Find every wallet owned by the login
+	if err := a.db.Where("owner_auth_id = ?", authID).
+		Order("account_id").
+		Find(&accounts).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
 		return
@@ -171,33 +192,109 @@ func (a *accountImplement) List(c *gin.Context) {
 
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
-		"data": accounts,
+		"data":              accounts,
+		"acting_account_id": c.GetInt64("account_id"),
 	})
 }
 
-func (a *accountImplement) My(c *gin.Context) {
-	var account model.Account
-	// get account_id from middleware auth
-	accountID := c.GetInt64("account_id")
+type walletCreatePayload struct {
+	Name     string `json:"name"`
+	Currency string `json:"currency"` // defaults to IDR
+}
 
-	// Find first data based on account_id given
-	if err := a.db.First(&account, accountID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-				"error": "Not found",
-			})
-			return
+func (a *accountImplement) CreateWallet(c *gin.Context) {
+	authID := c.GetInt64("auth_id")
+	payload := walletCreatePayload{}
+
+	// bind JSON Request to payload
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if payload.Name == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+		return
+	}
+
+	var account *model.Account
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		account, err = createAccount(tx, payload.Name, "", payload.Currency)
+		if err != nil {
+			return err
 		}
+		return setAccountOwner(tx, account, authID)
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	auditChange(c, "account.create_wallet", "account", account.AccountID, nil, snapshot(account))
 
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
+	// Success response
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Create success",
+		"data":    account,
+	})
+}
+
+// MoveBetweenWallets moves money from the acting account to another wallet of the same
+// login. There is no fee and none of the external transfer checks.
+func (a *accountImplement) MoveBetweenWallets(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+	authID := c.GetInt64("auth_id")
+	var payload struct {
+		TargetAccountID int64 `json:"target_account_id"`
+		Amount          int64 `json:"amount"`
+	}
+
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if payload.Amount <= 0 || payload.TargetAccountID == accountID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid transfer request"})
+		return
+	}
+
+	// The target must be one of my wallets
+	var target model.Account
+	if err := a.db.Where("account_id = ? AND owner_auth_id = ?", payload.TargetAccountID, authID).
+		First(&target).Error; err != nil {
+		abortWithError(c, errTargetNotFound)
+		return
+	}
+
+	if !screenOperation(c, a.db, a.fraud, fraudSignal{
+		Operation:       model.FraudOperationInternalTransfer,
+		AccountID:       accountID,
+		Amount:          payload.Amount,
+		TargetAccountID: &payload.TargetAccountID,
+	}, payload) {
+		return
+	}
+
+	var transactions []model.Transaction
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		transactions, err = executeTransfer(tx, transferRequest{
+			FromAccountID: accountID,
+			ToAccountID:   payload.TargetAccountID,
+			Amount:        payload.Amount,
+			Internal:      true,
 		})
+		return err
+	})
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
 
-	// Success response
 	c.JSON(http.StatusOK, gin.H{
-		"data": account,
+		"message": "Transfer successful",
+		"data":    transactions[0],
 	})
 }
 
@@ -217,30 +314,90 @@ func (a *accountImplement) Topup(c *gin.Context) {
 		return
 	}
 
-	tx := a.db.Begin()
+	if !screenOperation(c, a.db, a.fraud, fraudSignal{
+		Operation: model.FraudOperationTopup,
+		AccountID: accountID,
+		Amount:    payload.Amount,
+	}, payload) {
+		return
+	}
 
-	// Update account balance
-	if err := a.db.Model(&model.Account{}).Where("account_id = ?", accountID).
-		Update("balance", gorm.Expr("balance + ?", payload.Amount)).Error; err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		_, err := executeTopup(tx, accountID, payload.Amount, a.config)
+		return err
+	})
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{"message": "Topup successful"})
+}
+
+// executeTopup credits amount to the account from the cash-in system account
+// and pays the referral bonus on the first topup. It must be called inside a DB transaction.
+func executeTopup(tx *gorm.DB, accountID, amount int64, config AccountConfig) (*model.Transaction, error) {
+	var account model.Account
+	if err := tx.First(&account, accountID).Error; err != nil {
+		return nil, err
+	}
+
+	// Lock the referrer too, the referral bonus may be paid with this topup
+	lockIDs := []int64{accountID}
+	if account.ReferralAccountID != nil {
+		lockIDs = append(lockIDs, *account.ReferralAccountID)
+	}
+	locked, err := lockAccounts(tx, lockIDs...)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCanTopup(locked[accountID], config.FrozenAllowsTopup); err != nil {
+		return nil, err
+	}
+
+	if err := checkLimit(tx, locked[accountID], model.LimitTopup, amount); err != nil {
+		return nil, err
+	}
+
+	// The amount is in the account's currency
+	cashInID, err := systemAccountID(tx, systemAccountCashIn, account.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	// Money enters the wallet from the cash-in system account
+	entry, err := postJournalEntry(tx, model.EntryTypeTopup, "Topup", []model.Posting{
+		{AccountID: accountID, Amount: amount, Currency: account.Currency},
+		{AccountID: cashInID, Amount: -amount, Currency: account.Currency},
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	transaction := model.Transaction{
 		AccountID:       accountID,
-		Amount:          payload.Amount,
+		Amount:          amount,
 		TransactionDate: time.Now(),
+		TransactionType: model.TransactionTypeTopup,
+		JournalEntryID:  &entry.JournalEntryID,
+		Currency:        account.Currency,
 	}
 	if err := tx.Create(&transaction).Error; err != nil {
-		tx.Rollback()
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
+	}
+	if err := notifyTransactions(tx, transaction); err != nil {
+		return nil, err
+	}
+	if err := enqueueWebhookEvent(tx, model.EventTopupCompleted, accountID, transaction); err != nil {
+		return nil, err
 	}
 
-	// Commit transaksi
-	tx.Commit()
-
-	c.JSON(http.StatusOK, gin.H{"message": "Topup successful"})
+	if account.ReferralAccountID != nil {
+		if err := payReferralBonus(tx, &account, locked[*account.ReferralAccountID], config.ReferralBonus); err != nil {
+			return nil, err
+		}
+	}
+	return &transaction, nil
 }
 
 func (a *accountImplement) Transfer(c *gin.Context) {
@@ -260,89 +417,159 @@ func (a *accountImplement) Transfer(c *gin.Context) {
 		return
 	}
 
-	// Check balance
-	var account model.Account
-	if err := a.db.First(&account, accountID).Error; err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !screenOperation(c, a.db, a.fraud, fraudSignal{
+		Operation:       model.FraudOperationTransfer,
+		AccountID:       accountID,
+		Amount:          payload.Amount,
+		TargetAccountID: &payload.TargetAccountID,
+	}, payload) {
 		return
 	}
-	if account.Balance < payload.Amount {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Insufficient balance"})
+
+	var transactions []model.Transaction
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		transactions, err = executeTransfer(tx, transferRequest{
+			FromAccountID: accountID,
+			ToAccountID:   payload.TargetAccountID,
+			Amount:        payload.Amount,
+			Fee:           a.config.TransferFee,
+		})
+		return err
+	})
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
 
-	// Update balances
-	tx := a.db.Begin()
-	if err := tx.Model(&model.Account{}).Where("account_id = ?", accountID).
-		Update("balance", gorm.Expr("balance - ?", payload.Amount)).Error; err != nil {
-		tx.Rollback()
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Transfer successful",
+		"data":    transactions[0],
+	})
+}
+
+func (a *accountImplement) Balance(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	var account model.Account
+	if err := a.db.Select("balance", "held_balance", "currency").
+		First(&account, accountID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve balance"})
 		return
 	}
-	if err := tx.Model(&model.Account{}).Where("account_id = ?", payload.TargetAccountID).
-		Update("balance", gorm.Expr("balance + ?", payload.Amount)).Error; err != nil {
-		tx.Rollback()
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+
+	// balance is the ledger balance, held is reserved by holds
+	c.JSON(http.StatusOK, gin.H{
+		"balance":   account.Balance,
+		"held":      account.HeldBalance,
+		"available": account.Available(),
+		"currency":  account.Currency,
+	})
+}
+
+func (a *accountImplement) Mutation(c *gin.Context) {
+	// Ambil account_id dari context setelah authentication
+	accountID := c.GetInt64("account_id")
+
+	filter, err := parseTransactionFilter(c)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
 
-	// Catat transaksi pengirim
-	transactionSender := model.Transaction{
-		AccountID:       accountID,
-		TransactionCategoryID: nil, // Sesuaikan dengan kategori transaksi
-		Amount:          -payload.Amount, // Saldo berkurang untuk pengirim
-		TransactionDate: time.Now(),
+	transactions, nextCursor, err := findTransactionPage(a.db, accountID, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transactions"})
+		return
 	}
-	if err := tx.Create(&transactionSender).Error; err != nil {
-		tx.Rollback()
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+
+	c.JSON(http.StatusOK, gin.H{
+		"transactions": transactions,
+		"next_cursor":  nextCursor,
+	})
+}
+
+func (a *accountImplement) Statement(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	// month=YYYY-MM, the statement covers the whole calendar month
+	start, err := time.ParseInLocation("2006-01", c.Query("month"), time.Local)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid month, expected YYYY-MM"})
 		return
 	}
 
-	// Catat transaksi penerima
-	transactionReceiver := model.Transaction{
-		AccountID:       payload.TargetAccountID,
-		TransactionCategoryID: nil, // Sesuaikan dengan kategori transaksi
-		Amount:          payload.Amount, // Saldo bertambah untuk penerima
-		TransactionDate: time.Now(),
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid format, expected json or csv"})
+		return
 	}
-	if err := tx.Create(&transactionReceiver).Error; err != nil {
-		tx.Rollback()
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+
+	var account model.Account
+	if err := a.db.First(&account, accountID).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statement"})
 		return
 	}
 
-	tx.Commit()
-	c.JSON(http.StatusOK, gin.H{"message": "Transfer successful"})
-}
+	statement, err := buildStatement(a.db, &account, start, start.AddDate(0, 1, 0))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statement"})
+		return
+	}
 
-func (a *accountImplement) Balance(c *gin.Context) {
-	accountID := c.GetInt64("account_id")
+	if format == "csv" {
+		// Render first, a failure must not be sent as a truncated 200
+		var buf bytes.Buffer
+		if err := statement.writeCSV(&buf); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to build statement"})
+			return
+		}
 
-	var balance float64
-	if err := a.db.Model(&model.Account{}).
-		Where("account_id = ?", accountID).
-		Select("balance").
-		Scan(&balance).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve balance"})
+		c.Header("Content-Disposition", "attachment; filename=statement-"+statement.Month+".csv")
+		c.Data(http.StatusOK, "text/csv", buf.Bytes())
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"balance": balance})
+	c.JSON(http.StatusOK, gin.H{"data": statement})
 }
 
-func (a *accountImplement) Mutation(c *gin.Context) {
-	// Ambil account_id dari context setelah authentication
+type referralItem struct {
+	AccountID int64      `json:"account_id"`
+	Name      string     `json:"name"`
+	Rewarded  bool       `json:"rewarded"`
+	Earned    int64      `json:"earned"`
+	PaidAt    *time.Time `json:"paid_at,omitempty"`
+}
+
+func (a *accountImplement) Referrals(c *gin.Context) {
 	accountID := c.GetInt64("account_id")
 
-	var transactions []model.Transaction
-	if err := a.db.Where("account_id = ?", accountID).
-		Order("transaction_date DESC"). // Mengurutkan berdasarkan tanggal transaksi terbaru
-		Limit(10). // Membatasi hasil ke 10 transaksi terakhir
-		Find(&transactions).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transactions"})
+	var account model.Account
+	if err := a.db.First(&account, accountID).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"transactions": transactions})
+	// Everyone I referred, with the reward if it was already paid
+	referrals := []referralItem{}
+	if err := a.db.Table("accounts a").
+		Select("a.account_id, a.name, r.referral_reward_id IS NOT NULL AS rewarded, COALESCE(r.amount, 0) AS earned, r.created_at AS paid_at").
+		Joins("LEFT JOIN referral_rewards r ON r.referee_account_id = a.account_id").
+		Where("a.referral_account_id = ?", accountID).
+		Order("a.account_id").
+		Scan(&referrals).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var totalEarned int64
+	for _, r := range referrals {
+		totalEarned += r.Earned
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"referral_code": account.ReferralCode,
+		"referrals":     referrals,
+		"total_earned":  totalEarned,
+	})
 }
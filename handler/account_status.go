@@ -0,0 +1,442 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+var (
+	errAccountClosed       = newHTTPError(http.StatusForbidden, "ACCOUNT_CLOSED", "Account is closed")
+	errAccountClosing      = newHTTPError(http.StatusConflict, "ACCOUNT_CLOSING", "Account is being closed")
+	errTargetNotActive     = newHTTPError(http.StatusBadRequest, "TARGET_NOT_ACTIVE", "Target account can't receive money")
+	errSweepRequired       = newHTTPError(http.StatusBadRequest, "SWEEP_ACCOUNT_REQUIRED", "The remaining balance needs a sweep_account_id")
+	errInvalidSweepAccount = newHTTPError(http.StatusBadRequest, "INVALID_SWEEP_ACCOUNT", "Invalid sweep account")
+	errReopenNotAllowed    = newHTTPError(http.StatusConflict, "REOPEN_NOT_ALLOWED", "Account is not closed or the grace period is over")
+	errAccountFrozen       = newHTTPError(http.StatusForbidden, "ACCOUNT_FROZEN", "Account is frozen")
+	errAccountSuspended    = newHTTPError(http.StatusForbidden, "ACCOUNT_SUSPENDED", "Account is suspended")
+	errReasonRequired      = newHTTPError(http.StatusBadRequest, "REASON_REQUIRED", "Reason is required")
+)
+
+// checkActive fails when the account is not active, with the code of its status
+func checkActive(account *model.Account) error {
+	switch account.Status {
+	case model.AccountActive:
+		return nil
+	case model.AccountClosing:
+		return errAccountClosing
+	case model.AccountFrozen:
+		return errAccountFrozen
+	case model.AccountSuspended:
+		return errAccountSuspended
+	}
+	return errAccountClosed
+}
+
+// checkCanTopup lets money in to active accounts, and to frozen ones when the setting allows it
+func checkCanTopup(account *model.Account, frozenAllowsTopup bool) error {
+	if frozenAllowsTopup && account.Status == model.AccountFrozen {
+		return nil
+	}
+	return checkActive(account)
+}
+
+// checkCanSend fails when money can't leave the account.
+// Closing accounts still settle holds and sweep their balance.
+func checkCanSend(account *model.Account, settling bool) error {
+	if settling && account.Status == model.AccountClosing {
+		return nil
+	}
+	return checkActive(account)
+}
+
+// checkCanReceive fails when money can't enter the account.
+// A freeze only stops money going out.
+func checkCanReceive(account *model.Account) error {
+	if account.Status != model.AccountActive && account.Status != model.AccountFrozen {
+		return errTargetNotActive
+	}
+	return nil
+}
+
+// checkLoginAllowed fails when the account of the login is closed or suspended
+func checkLoginAllowed(db *gorm.DB, auth *model.Auth) error {
+	var account model.Account
+	err := db.Select("account_id", "status").First(&account, auth.AccountID).Error
+	if err == gorm.ErrRecordNotFound {
+		return errAccountClosed
+	}
+	if err != nil {
+		return err
+	}
+	if account.Status == model.AccountSuspended {
+		return errAccountSuspended
+	}
+	return nil
+}
+
+// recordStatusChange writes the status history of the account
+func recordStatusChange(tx *gorm.DB, c *gin.Context, accountID int64, from, to, reason string) error {
+	return tx.Create(&model.AccountStatusChange{
+		AccountID:  accountID,
+		FromStatus: from,
+		ToStatus:   to,
+		Reason:     reason,
+		ChangedBy:  c.GetInt64("auth_id"),
+	}).Error
+}
+
+// revokeAccountLogins logs out every session that can act as the account: the
+// logins of the account and the login owning it as a wallet. The owner's sessions
+// are revoked as a whole, which also logs it out of its other wallets.
+func revokeAccountLogins(tx *gorm.DB, accountID int64) error {
+	return tx.Model(&model.RefreshToken{}).
+		Where("revoked_at IS NULL AND (auth_id IN (?) OR auth_id IN (?))",
+			tx.Model(&model.Auth{}).Select("auth_id").Where("account_id = ?", accountID),
+			tx.Model(&model.Account{}).Unscoped().Select("owner_auth_id").
+				Where("account_id = ? AND owner_auth_id IS NOT NULL", accountID)).
+		Update("revoked_at", time.Now()).Error
+}
+
+type accountStatusPayload struct {
+	Status string `json:"status"` // active, frozen or suspended
+	Reason string `json:"reason"`
+}
+
+// SetStatus freezes, suspends or reactivates an account, for admins.
+// Closing and closed accounts go through the closure workflow instead.
+func (a *accountImplement) SetStatus(c *gin.Context) {
+	payload := accountStatusPayload{}
+
+	// bind JSON Request to payload
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch payload.Status {
+	case model.AccountActive, model.AccountFrozen, model.AccountSuspended:
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid status, expected active, frozen or suspended"})
+		return
+	}
+	if payload.Reason == "" {
+		abortWithError(c, errReasonRequired)
+		return
+	}
+
+	// get id from url account/status/5, 5 will be the id
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	var before, account model.Account
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		accounts, err := lockAccounts(tx, id)
+		if err != nil {
+			return err
+		}
+		locked, ok := accounts[id]
+		if !ok || locked.SystemCode != nil {
+			return newHTTPError(http.StatusNotFound, "ACCOUNT_NOT_FOUND", "Not found")
+		}
+		before, account = *locked, *locked
+
+		if account.Status == model.AccountClosing {
+			return errAccountClosing
+		}
+		if account.Status == payload.Status {
+			return nil
+		}
+
+		account.Status = payload.Status
+		if err := tx.Model(&account).Update("status", account.Status).Error; err != nil {
+			return err
+		}
+		if err := recordStatusChange(tx, c, account.AccountID, before.Status, account.Status, payload.Reason); err != nil {
+			return err
+		}
+
+		// Suspended logins are logged out right away
+		if account.Status == model.AccountSuspended {
+			return revokeAccountLogins(tx, account.AccountID)
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	auditChange(c, "account.set_status", "account", account.AccountID, snapshot(before), snapshot(account))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Status saved",
+		"data":    account,
+	})
+}
+
+// StatusHistory lists the status changes of an account, newest first
+func (a *accountImplement) StatusHistory(c *gin.Context) {
+	changes := []model.AccountStatusChange{}
+	if err := a.db.Where("account_id = ?", c.Param("id")).
+		Order("account_status_change_id DESC").
+		Find(&changes).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": changes})
+}
+
+type accountClosePayload struct {
+	SweepAccountID *int64 `json:"sweep_account_id"` // receives the remaining balance
+	Reason         string `json:"reason"`
+}
+
+// closeAccount sweeps the balance to the nominated account and closes the account.
+// With holds still authorized the account only becomes closing, and closing it
+// again after the holds settled finishes the closure.
+func closeAccount(tx *gorm.DB, c *gin.Context, accountID int64, sweepAccountID *int64, reason string) (*model.Account, error) {
+	lockIDs := []int64{accountID}
+	if sweepAccountID != nil {
+		lockIDs = append(lockIDs, *sweepAccountID)
+	}
+	accounts, err := lockAccounts(tx, lockIDs...)
+	if err != nil {
+		return nil, err
+	}
+	account, ok := accounts[accountID]
+	if !ok || account.SystemCode != nil {
+		return nil, errAccountClosed
+	}
+
+	// Frozen and suspended accounts are closed only after compliance lifted the status
+	switch account.Status {
+	case model.AccountActive:
+		account.Status = model.AccountClosing
+		if err := tx.Model(account).Update("status", account.Status).Error; err != nil {
+			return nil, err
+		}
+		if err := recordStatusChange(tx, c, accountID, model.AccountActive, account.Status, reason); err != nil {
+			return nil, err
+		}
+	case model.AccountClosing:
+	default:
+		return nil, checkActive(account)
+	}
+	if account.HeldBalance > 0 {
+		return account, nil
+	}
+
+	if account.Balance > 0 {
+		if sweepAccountID == nil {
+			return nil, errSweepRequired
+		}
+		if _, ok := accounts[*sweepAccountID]; !ok || *sweepAccountID == accountID {
+			return nil, errInvalidSweepAccount
+		}
+
+		// Recorded as a closure payout, without fee or limits since the whole balance leaves
+		if _, err := executeTransfer(tx, transferRequest{
+			FromAccountID: accountID,
+			ToAccountID:   *sweepAccountID,
+			Amount:        account.Balance,
+			Settling:      true,
+			Payout:        true,
+		}); err != nil {
+			return nil, err
+		}
+		account.Balance = 0
+	}
+
+	// Nothing runs on a closed account anymore
+	if err := tx.Model(&model.StandingOrder{}).
+		Where("status = ? AND (account_id = ? OR target_account_id = ?)", model.StandingOrderActive, accountID, accountID).
+		Update("status", model.StandingOrderCancelled).Error; err != nil {
+		return nil, err
+	}
+
+	if err := detachLogins(tx, accountID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	account.Status = model.AccountClosed
+	account.ClosedAt = &now
+	if err := tx.Model(account).Updates(map[string]interface{}{
+		"status":    account.Status,
+		"closed_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+	if err := recordStatusChange(tx, c, accountID, model.AccountClosing, account.Status, reason); err != nil {
+		return nil, err
+	}
+	return account, tx.Delete(account).Error
+}
+
+// detachLogins moves the logins of a closing account to another open wallet of
+// theirs. A login without one is logged out and can't login anymore.
+func detachLogins(tx *gorm.DB, accountID int64) error {
+	var auths []model.Auth
+	if err := tx.Where("account_id = ?", accountID).Find(&auths).Error; err != nil {
+		return err
+	}
+
+	for _, auth := range auths {
+		var other model.Account
+		err := tx.Where("owner_auth_id = ? AND account_id <> ? AND status = ?", auth.AuthID, accountID, model.AccountActive).
+			Order("account_id").
+			Take(&other).Error
+		if err == nil {
+			if err := tx.Model(&auth).Update("account_id", other.AccountID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		if err := tx.Model(&model.RefreshToken{}).
+			Where("auth_id = ? AND revoked_at IS NULL", auth.AuthID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *accountImplement) respondClosure(c *gin.Context, accountID int64, payload accountClosePayload) {
+	var before, account *model.Account
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		before = &model.Account{}
+		if err := tx.First(before, accountID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return errAccountClosed
+			}
+			return err
+		}
+
+		var err error
+		account, err = closeAccount(tx, c, accountID, payload.SweepAccountID, payload.Reason)
+		return err
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	auditChange(c, "account.close", "account", accountID, snapshot(before), snapshot(account))
+
+	if account.Status == model.AccountClosing {
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "Account is closing, close it again once its holds are settled",
+			"data":    account,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Account closed",
+		"data":    account,
+	})
+}
+
+// Close closes the acting account of the caller
+func (a *accountImplement) Close(c *gin.Context) {
+	payload := accountClosePayload{}
+	if err := c.ShouldBindJSON(&payload); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if payload.Reason == "" {
+		payload.Reason = "Closed by the account owner"
+	}
+
+	a.respondClosure(c, c.GetInt64("account_id"), payload)
+}
+
+// Delete closes any account, for admins. Nothing is deleted, the account is kept as closed.
+func (a *accountImplement) Delete(c *gin.Context) {
+	// get id from url account/delete/5, 5 will be the id
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	payload := accountClosePayload{}
+	if err := c.ShouldBindJSON(&payload); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if payload.Reason == "" {
+		abortWithError(c, errReasonRequired)
+		return
+	}
+
+	a.respondClosure(c, id, payload)
+}
+
+// Reopen makes a closed account active again within the grace period, for admins
+func (a *accountImplement) Reopen(c *gin.Context) {
+	var payload struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if payload.Reason == "" {
+		abortWithError(c, errReasonRequired)
+		return
+	}
+
+	var before, account model.Account
+	err := a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().First(&account, "account_id = ?", c.Param("id")).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return newHTTPError(http.StatusNotFound, "ACCOUNT_NOT_FOUND", "Not found")
+			}
+			return err
+		}
+		before = account
+
+		if account.Status != model.AccountClosed || account.ClosedAt == nil ||
+			time.Since(*account.ClosedAt) > a.config.ReopenGracePeriod {
+			return errReopenNotAllowed
+		}
+
+		account.Status = model.AccountActive
+		account.ClosedAt = nil
+		account.DeletedAt = gorm.DeletedAt{}
+		if err := tx.Unscoped().Model(&account).Updates(map[string]interface{}{
+			"status":     account.Status,
+			"closed_at":  nil,
+			"deleted_at": nil,
+		}).Error; err != nil {
+			return err
+		}
+		return recordStatusChange(tx, c, account.AccountID, before.Status, account.Status, payload.Reason)
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	auditChange(c, "account.reopen", "account", account.AccountID, snapshot(before), snapshot(account))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Account reopened",
+		"data":    account,
+	})
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"task-golang-db/model"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type AuditInterface interface {
+	List(*gin.Context)
+}
+
+type auditImplement struct {
+	db *gorm.DB
+}
+
+func NewAudit(db *gorm.DB) AuditInterface {
+	return &auditImplement{
+		db: db,
+	}
+}
+
+// snapshot is the JSON of v at the time of the call
+func snapshot(v interface{}) json.RawMessage {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+// authSnapshot leaves the password hash out of the audit log
+func authSnapshot(auth *model.Auth) json.RawMessage {
+	return snapshot(gin.H{
+		"auth_id":    auth.AuthID,
+		"account_id": auth.AccountID,
+		"username":   auth.Username,
+		"role":       auth.Role,
+	})
+}
+
+// auditChange describes the change made by the request, the audit middleware records it.
+// Before is nil for creations, after is nil for deletions.
+func auditChange(c *gin.Context, action, entity string, entityID interface{}, before, after json.RawMessage) {
+	c.Set("audit", &model.AuditChange{
+		Action:   action,
+		Entity:   entity,
+		EntityID: fmt.Sprint(entityID),
+		Before:   before,
+		After:    after,
+	})
+}
+
+// List finds audit rows, newest first. Filters: auth_id, action, entity, entity_id,
+// request_id, from, to. Pages continue with the next_cursor of the previous page.
+func (a *auditImplement) List(c *gin.Context) {
+	query := a.db.Model(&model.AuditLog{})
+	for _, column := range []string{"auth_id", "action", "entity", "entity_id", "request_id"} {
+		if v := c.Query(column); v != "" {
+			query = query.Where(column+" = ?", v)
+		}
+	}
+
+	if s := c.Query("from"); s != "" {
+		from, err := parseDate(s, false)
+		if err != nil {
+			abortWithError(c, invalidFilter("from"))
+			return
+		}
+		query = query.Where("created_at >= ?", *from)
+	}
+	if s := c.Query("to"); s != "" {
+		to, err := parseDate(s, true)
+		if err != nil {
+			abortWithError(c, invalidFilter("to"))
+			return
+		}
+		query = query.Where("created_at < ?", *to)
+	}
+
+	limit := defaultPageSize
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			abortWithError(c, invalidFilter("limit"))
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+	if s := c.Query("cursor"); s != "" {
+		cursor, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			abortWithError(c, invalidFilter("cursor"))
+			return
+		}
+		query = query.Where("audit_log_id < ?", cursor)
+	}
+
+	logs := []model.AuditLog{}
+	if err := query.Order("audit_log_id DESC").Limit(limit + 1).Find(&logs).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	nextCursor := ""
+	if len(logs) > limit {
+		logs = logs[:limit]
+		nextCursor = strconv.FormatInt(logs[limit-1].AuditLogID, 10)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":        logs,
+		"next_cursor": nextCursor,
+	})
+}
@@ -1,9 +1,14 @@
 package handler
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"task-golang-db/model"
 	"net/http"
+	"task-golang-db/model"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,9 +20,20 @@ import (
 
 type AuthInterface interface {
 	Login(*gin.Context)
-	Upsert(*gin.Context)
+	Register(*gin.Context)
+	ChangePassword(*gin.Context)
+	AdminSetCredentials(*gin.Context)
+	Refresh(*gin.Context)
+	Logout(*gin.Context)
+	SetRole(*gin.Context)
 }
 
+// Access tokens are short lived, refresh tokens rotate on every use
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
 type authImplement struct {
 	db         *gorm.DB
 	signingKey []byte
@@ -73,30 +89,210 @@ func (a *authImplement) Login(c *gin.Context) {
 		return
 	}
 
-	// Login is valid
-	token, err := a.createJWT(&auth)
+	// Closed accounts can't login
+	if err := checkLoginAllowed(a.db, &auth); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Login is valid, start a new refresh token family
+	familyID, err := randomToken(16)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	token, refreshToken, err := a.issueTokens(a.db, &auth, familyID)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Success response
+	c.JSON(http.StatusOK, gin.H{
+		"message":       fmt.Sprintf("%v Login Sukses", payload.Username),
+		"data":          token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+	})
+}
+
+const minPasswordLength = 8
+
+var (
+	errUsernameTaken   = newHTTPError(http.StatusConflict, "USERNAME_TAKEN", "Username already taken")
+	errWeakPassword    = newHTTPError(http.StatusBadRequest, "WEAK_PASSWORD", fmt.Sprintf("Password must have at least %d characters", minPasswordLength))
+	errInvalidUsername = newHTTPError(http.StatusBadRequest, "INVALID_USERNAME", "Username is required")
+)
+
+// hashPassword validates and hashes a new password
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errWeakPassword
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// checkUsernameFree fails when another login, other than authID, uses the username
+func checkUsernameFree(db *gorm.DB, username string, authID int64) error {
+	if username == "" {
+		return errInvalidUsername
+	}
+
+	var count int64
+	if err := db.Model(&model.Auth{}).
+		Where("username = ? AND auth_id <> ?", username, authID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return errUsernameTaken
+	}
+	return nil
+}
+
+type authRegisterPayload struct {
+	Name         string `json:"name"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	ReferralCode string `json:"referral_code"`
+	Currency     string `json:"currency"`
+}
+
+func (a *authImplement) Register(c *gin.Context) {
+	payload := authRegisterPayload{}
+
+	// parsing JSON payload to struct model
+	err := c.BindJSON(&payload)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": err,
 		})
 		return
 	}
 
+	// Hash Given Password
+	hashed, err := hashPassword(payload.Password)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Account and login are created together or not at all
+	var account *model.Account
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		if err := checkUsernameFree(tx, payload.Username, 0); err != nil {
+			return err
+		}
+
+		var err error
+		account, err = createAccount(tx, payload.Name, payload.ReferralCode, payload.Currency)
+		if err != nil {
+			return err
+		}
+
+		auth := model.Auth{
+			AccountID: account.AccountID,
+			Username:  payload.Username,
+			Password:  hashed,
+			Role:      model.RoleUser,
+		}
+		if err := tx.Create(&auth).Error; err != nil {
+			return err
+		}
+		auditChange(c, "auth.register", "auth", auth.AuthID, nil, authSnapshot(&auth))
+
+		return setAccountOwner(tx, account, auth.AuthID)
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
-		"message": fmt.Sprintf("%v Login Sukses", payload.Username),
-		"data":    token,
+		"message": "Register success",
+		"data":    account,
 	})
 }
 
-type authUpsertPayload struct {
+type authPasswordPayload struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func (a *authImplement) ChangePassword(c *gin.Context) {
+	authID := c.GetInt64("auth_id")
+	payload := authPasswordPayload{}
+
+	// parsing JSON payload to struct model
+	err := c.BindJSON(&payload)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	auth := model.Auth{}
+	if err := a.db.First(&auth, authID).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Validate current password
+	if err := bcrypt.CompareHashAndPassword([]byte(auth.Password), []byte(payload.CurrentPassword)); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Current password not valid",
+		})
+		return
+	}
+
+	hashed, err := hashPassword(payload.NewPassword)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&auth).Update("password", hashed).Error; err != nil {
+			return err
+		}
+		auditChange(c, "auth.change_password", "auth", auth.AuthID, nil, nil)
+		return a.recordCredentialChange(tx, c, auth.AuthID, model.CredentialPasswordChange, "")
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Success response
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Password changed, other sessions are logged out",
+	})
+}
+
+type authAdminCredentialsPayload struct {
 	AccountID int64  `json:"account_id"`
 	Username  string `json:"username"`
 	Password  string `json:"password"`
+	Reason    string `json:"reason"`
 }
 
-func (a *authImplement) Upsert(c *gin.Context) {
-	payload := authUpsertPayload{}
+// AdminSetCredentials creates or resets the login of an account, for admins only
+func (a *authImplement) AdminSetCredentials(c *gin.Context) {
+	payload := authAdminCredentialsPayload{}
 
 	// parsing JSON payload to struct model
 	err := c.BindJSON(&payload)
@@ -107,15 +303,20 @@ func (a *authImplement) Upsert(c *gin.Context) {
 		return
 	}
 
-	// Hash Given Password
-	hashed, err := bcrypt.GenerateFromPassword([]byte(payload.Password), bcrypt.DefaultCost)
-	if err != nil {
+	if payload.Reason == "" {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"error": err,
+			"error": "Reason is required",
 		})
 		return
 	}
 
+	// Hash Given Password
+	hashed, err := hashPassword(payload.Password)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
 	// Check AccountID is valid
 	var account model.Account
 	if err := a.db.First(&account, payload.AccountID).Error; err != nil {
@@ -132,43 +333,307 @@ func (a *authImplement) Upsert(c *gin.Context) {
 		return
 	}
 
-	// Prepare new auth data with new password
-	auth := model.Auth{
-		AccountID: payload.AccountID,
-		Username:  payload.Username,
-		Password:  string(hashed),
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		auth := model.Auth{}
+		err := tx.Where("account_id = ?", payload.AccountID).First(&auth).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		if err := checkUsernameFree(tx, payload.Username, auth.AuthID); err != nil {
+			return err
+		}
+
+		var before json.RawMessage
+		if auth.AuthID != 0 {
+			before = authSnapshot(&auth)
+		}
+
+		// Create the login or overwrite its credentials, the role is kept
+		auth.AccountID = payload.AccountID
+		auth.Username = payload.Username
+		auth.Password = hashed
+		if err := tx.Save(&auth).Error; err != nil {
+			return err
+		}
+		auditChange(c, "auth.admin_set_credentials", "auth", auth.AuthID, before, authSnapshot(&auth))
+
+		// An account created by an admin gets its owner with the first login
+		if account.OwnerAuthID == nil {
+			if err := setAccountOwner(tx, &account, auth.AuthID); err != nil {
+				return err
+			}
+		}
+
+		return a.recordCredentialChange(tx, c, auth.AuthID, model.CredentialAdminSet, payload.Reason)
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Success response
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Credentials saved",
+		"data":    payload.Username,
+	})
+}
+
+// recordCredentialChange writes the audit record and logs out every session of the login
+func (a *authImplement) recordCredentialChange(tx *gorm.DB, c *gin.Context, authID int64, action, reason string) error {
+	audit := model.CredentialAudit{
+		AuthID:      authID,
+		ActorAuthID: c.GetInt64("auth_id"),
+		Action:      action,
+		Reason:      reason,
+		IP:          c.ClientIP(),
+	}
+	if err := tx.Create(&audit).Error; err != nil {
+		return err
 	}
 
-	// Upsert auth data (Insert or Update if already exists)
-	result := a.db.Clauses(
-		clause.OnConflict{
-			DoUpdates: clause.AssignmentColumns([]string{"username", "password"}),
-			Columns:   []clause.Column{{Name: "account_id"}},
-		}).Create(&auth)
-	if result.Error != nil {
+	return tx.Model(&model.RefreshToken{}).
+		Where("auth_id = ? AND revoked_at IS NULL", authID).
+		Update("revoked_at", time.Now()).Error
+}
+
+type authRefreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (a *authImplement) Refresh(c *gin.Context) {
+	payload := authRefreshPayload{}
+
+	// parsing JSON payload to struct model
+	err := c.BindJSON(&payload)
+	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"error": result.Error.Error(),
+			"error": err,
 		})
 		return
 	}
 
+	var token, refreshToken string
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		stored := model.RefreshToken{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token_hash = ?", hashToken(payload.RefreshToken)).
+			First(&stored).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return errInvalidRefreshToken
+			}
+			return err
+		}
+
+		now := time.Now()
+
+		// A rotated token used again means it leaked, the whole family gets revoked
+		if stored.RevokedAt != nil {
+			return errRefreshTokenReused
+		}
+		if now.After(stored.ExpiresAt) {
+			return errInvalidRefreshToken
+		}
+
+		// Rotate, the old token can't be used anymore
+		if err := tx.Model(&stored).Update("revoked_at", now).Error; err != nil {
+			return err
+		}
+
+		// Reload auth so the new access token carries current data
+		auth := model.Auth{}
+		if err := tx.First(&auth, stored.AuthID).Error; err != nil {
+			return err
+		}
+		if err := checkLoginAllowed(tx, &auth); err != nil {
+			return err
+		}
+
+		var err error
+		token, refreshToken, err = a.issueTokens(tx, &auth, stored.FamilyID)
+		return err
+	})
+	if err == errRefreshTokenReused {
+		// Outside the transaction, which is rolled back
+		a.revokeReusedFamily(payload.RefreshToken)
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Create success",
-		"data":    payload.Username,
+		"data":          token,
+		"refresh_token": refreshToken,
+		"expires_in":    int(accessTokenTTL.Seconds()),
+	})
+}
+
+func (a *authImplement) Logout(c *gin.Context) {
+	// Revoke the access token until it expires
+	revoked := model.RevokedToken{
+		Jti:       c.GetString("jti"),
+		ExpiresAt: c.GetTime("token_expires_at"),
+	}
+	if err := a.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// and the refresh tokens of this login session
+	if sessionID := c.GetString("session_id"); sessionID != "" {
+		if err := revokeTokenFamily(a.db, sessionID); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	// Success response
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Logout success",
+	})
+}
+
+type authRolePayload struct {
+	AuthID int64  `json:"auth_id"`
+	Role   string `json:"role"`
+}
+
+func (a *authImplement) SetRole(c *gin.Context) {
+	payload := authRolePayload{}
+
+	// parsing JSON payload to struct model
+	err := c.BindJSON(&payload)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err,
+		})
+		return
+	}
+
+	if payload.Role != model.RoleUser && payload.Role != model.RoleAdmin && payload.Role != model.RoleSupport {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid role, expected user, admin or support",
+		})
+		return
+	}
+
+	auth := model.Auth{}
+	if err := a.db.First(&auth, payload.AuthID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "Not found",
+			})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	before := authSnapshot(&auth)
+
+	// The new role is in the claims from the next refresh on
+	if err := a.db.Model(&auth).Update("role", payload.Role).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	auditChange(c, "auth.set_role", "auth", auth.AuthID, before, authSnapshot(&auth))
+
+	// Success response
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Update success",
 	})
 }
 
-func (a *authImplement) createJWT(auth *model.Auth) (string, error) {
+var (
+	errInvalidRefreshToken = newHTTPError(http.StatusUnauthorized, "INVALID_REFRESH_TOKEN", "Invalid refresh token")
+	errRefreshTokenReused  = newHTTPError(http.StatusUnauthorized, "REFRESH_TOKEN_REUSED", "Refresh token reuse detected, please login again")
+)
+
+// revokeReusedFamily revokes the family of a reused refresh token
+func (a *authImplement) revokeReusedFamily(refreshToken string) {
+	stored := model.RefreshToken{}
+	if err := a.db.Where("token_hash = ?", hashToken(refreshToken)).First(&stored).Error; err == nil {
+		revokeTokenFamily(a.db, stored.FamilyID)
+	}
+}
+
+// revokeTokenFamily revokes every refresh token of a login session
+func revokeTokenFamily(db *gorm.DB, familyID string) error {
+	return db.Model(&model.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// randomToken returns n random bytes, base64 URL encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens creates an access token and a refresh token in the given family
+func (a *authImplement) issueTokens(db *gorm.DB, auth *model.Auth, familyID string) (string, string, error) {
+	token, err := a.createJWT(auth, familyID)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Only the hash is stored
+	stored := model.RefreshToken{
+		AuthID:    auth.AuthID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+	if err := db.Create(&stored).Error; err != nil {
+		return "", "", err
+	}
+
+	return token, refreshToken, nil
+}
+
+func (a *authImplement) createJWT(auth *model.Auth, familyID string) (string, error) {
+	// Unique token id, used to revoke the token on logout
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+
 	// Create the jwt token signer
 	token := jwt.New(jwt.SigningMethodHS256)
 
 	// Add claims data or additional data (avoid to put secret information in the payload or header elements)
+	now := time.Now()
 	claims := token.Claims.(jwt.MapClaims)
+	claims["jti"] = jti
+	claims["sid"] = familyID
 	claims["auth_id"] = auth.AuthID
 	claims["account_id"] = auth.AccountID
 	claims["username"] = auth.Username
-	claims["exp"] = time.Now().Add(time.Hour * 72).Unix() // Token expires in 72 hours
+	claims["role"] = auth.Role
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(accessTokenTTL).Unix() // Token expires in 15 minutes
 
 	// Encode
 	tokenString, err := token.SignedString(a.signingKey)
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"os"
+	"testing"
+
+	"task-golang-db/model"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB connects to the database in TEST_DATABASE, which must have the
+// schema of digi-milasibarani02.sql. Tests that need it are skipped without it.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	return db
+}
+
+// newFundedAccount creates an account in currency with balance topped up through the ledger
+func newFundedAccount(t *testing.T, db *gorm.DB, currency string, balance int64) *model.Account {
+	t.Helper()
+
+	account, err := createAccount(db, t.Name(), "", currency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance > 0 {
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := executeTopup(tx, account.AccountID, balance, AccountConfig{})
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return account
+}
+
+func balanceOf(t *testing.T, db *gorm.DB, accountID int64) int64 {
+	t.Helper()
+
+	var account model.Account
+	if err := db.Unscoped().First(&account, accountID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return account.Balance
+}
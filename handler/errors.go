@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// httpError is an error that knows its response status and carries a
+// machine readable code the app can use to pick the right message.
+// details are added to the response body.
+type httpError struct {
+	status  int
+	code    string
+	message string
+	details gin.H
+}
+
+func (e *httpError) Error() string {
+	return e.message
+}
+
+func newHTTPError(status int, code, message string) *httpError {
+	return &httpError{status: status, code: code, message: message}
+}
+
+// abortWithError writes err as the JSON error response,
+// errors without a known status are internal server errors.
+func abortWithError(c *gin.Context, err error) {
+	var he *httpError
+	if errors.As(err, &he) {
+		body := gin.H{
+			"error": he.message,
+			"code":  he.code,
+		}
+		for k, v := range he.details {
+			body[k] = v
+		}
+		c.AbortWithStatusJSON(he.status, body)
+		return
+	}
+
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
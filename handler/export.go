@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"task-golang-db/model"
+	"time"
+)
+
+// transactionExporter writes transactions one by one so an export never holds
+// the whole history in memory.
+type transactionExporter interface {
+	contentType() string
+	begin(w io.Writer) error
+	write(w io.Writer, t *model.Transaction) error
+	end(w io.Writer) error
+}
+
+func newTransactionExporter(format string, account *model.Account, filter transactionFilter) transactionExporter {
+	switch format {
+	case "csv":
+		return &csvExporter{}
+	case "ofx":
+		return &ofxExporter{account: account, filter: filter}
+	case "qif":
+		return &qifExporter{}
+	}
+	return nil
+}
+
+type csvExporter struct {
+	cw *csv.Writer
+}
+
+func (e *csvExporter) contentType() string { return "text/csv" }
+
+func (e *csvExporter) begin(w io.Writer) error {
+	e.cw = csv.NewWriter(w)
+	return e.cw.Write([]string{
+		"transaction_id", "transaction_date", "transaction_type", "transaction_category_id",
+		"from_account_id", "to_account_id", "amount",
+	})
+}
+
+func (e *csvExporter) write(w io.Writer, t *model.Transaction) error {
+	optional := func(v *int64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatInt(*v, 10)
+	}
+
+	err := e.cw.Write([]string{
+		strconv.FormatInt(t.TransactionID, 10),
+		t.TransactionDate.Format(time.RFC3339),
+		t.TransactionType,
+		optional(t.TransactionCategoryID),
+		optional(t.FromAccountID),
+		optional(t.ToAccountID),
+		strconv.FormatInt(t.Amount, 10),
+	})
+	e.cw.Flush()
+	return err
+}
+
+func (e *csvExporter) end(w io.Writer) error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+// ofxExporter writes an OFX 2.2 bank statement
+type ofxExporter struct {
+	account *model.Account
+	filter  transactionFilter
+}
+
+func (e *ofxExporter) contentType() string { return "application/x-ofx" }
+
+func (e *ofxExporter) begin(w io.Writer) error {
+	const ofxDate = "20060102150405"
+	start, end := time.Unix(0, 0), time.Now()
+	if e.filter.From != nil {
+		start = *e.filter.From
+	}
+	if e.filter.To != nil {
+		end = *e.filter.To
+	}
+
+	_, err := fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+<BANKMSGSRSV1>
+<STMTTRNRS>
+<TRNUID>0</TRNUID>
+<STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+<STMTRS>
+<CURDEF>%s</CURDEF>
+<BANKACCTFROM><BANKID>WALLET</BANKID><ACCTID>%d</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>
+<BANKTRANLIST>
+<DTSTART>%s</DTSTART>
+<DTEND>%s</DTEND>
+`, e.account.Currency, e.account.AccountID, start.Format(ofxDate), end.Format(ofxDate))
+	return err
+}
+
+func (e *ofxExporter) write(w io.Writer, t *model.Transaction) error {
+	trnType := "CREDIT"
+	if t.Amount < 0 {
+		trnType = "DEBIT"
+	}
+
+	_, err := fmt.Fprintf(w,
+		"<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%d</TRNAMT><FITID>%d</FITID><NAME>%s</NAME></STMTTRN>\n",
+		trnType, t.TransactionDate.Format("20060102150405"), t.Amount, t.TransactionID, t.TransactionType)
+	return err
+}
+
+func (e *ofxExporter) end(w io.Writer) error {
+	_, err := io.WriteString(w, "</BANKTRANLIST>\n</STMTRS>\n</STMTTRNRS>\n</BANKMSGSRSV1>\n</OFX>\n")
+	return err
+}
+
+type qifExporter struct{}
+
+func (e *qifExporter) contentType() string { return "application/qif" }
+
+func (e *qifExporter) begin(w io.Writer) error {
+	_, err := io.WriteString(w, "!Type:Bank\n")
+	return err
+}
+
+func (e *qifExporter) write(w io.Writer, t *model.Transaction) error {
+	_, err := fmt.Fprintf(w, "D%s\nT%d\nN%d\nP%s\n^\n",
+		t.TransactionDate.Format("01/02/2006"), t.Amount, t.TransactionID, t.TransactionType)
+	return err
+}
+
+func (e *qifExporter) end(w io.Writer) error {
+	return nil
+}
@@ -0,0 +1,391 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Fraud rule actions
+const (
+	fraudActionBlock  = "block"
+	fraudActionReview = "review"
+)
+
+var errFraudBlocked = newHTTPError(http.StatusForbidden, "FRAUD_BLOCKED", "Operation blocked by fraud screening")
+
+// fraudOperationTypes maps a screened operation to the transactions it creates for the account
+var fraudOperationTypes = map[string]string{
+	model.FraudOperationTopup:            model.TransactionTypeTopup,
+	model.FraudOperationTransfer:         model.TransactionTypeTransferOut,
+	model.FraudOperationInternalTransfer: model.TransactionTypeInternalOut,
+	model.FraudOperationTransaction:      model.TransactionTypeManual,
+}
+
+// fraudSignal describes the operation being screened
+type fraudSignal struct {
+	Operation       string
+	AccountID       int64
+	AuthID          int64
+	SessionID       string
+	Amount          int64
+	TargetAccountID *int64
+}
+
+// fraudRuleConfig is one rule of the rules file. Only the fields used by its type are read.
+type fraudRuleConfig struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Action     string   `json:"action"`     // block or review
+	Operations []string `json:"operations"` // topup, transfer, internal_transfer or transaction, empty for all
+	MinAmount  int64    `json:"min_amount"` // the rule is skipped below this amount
+	Window     string   `json:"window"`     // velocity and new_login, a duration like "10m"
+	MaxCount   int64    `json:"max_count"`  // velocity
+	Multiplier float64  `json:"multiplier"` // unusual_amount, defaults to 3
+	History    int      `json:"history"`    // unusual_amount, past transactions compared, defaults to 10
+}
+
+// fraudRule decides whether a signal matches
+type fraudRule interface {
+	match(db *gorm.DB, s *fraudSignal) (bool, error)
+}
+
+// fraudRuleTypes builds a rule from its config, new kinds of rules are added here
+var fraudRuleTypes = map[string]func(fraudRuleConfig) (fraudRule, error){
+	"amount":               newAmountRule,
+	"velocity":             newVelocityRule,
+	"first_time_recipient": newFirstTimeRecipientRule,
+	"unusual_amount":       newUnusualAmountRule,
+	"new_login":            newNewLoginRule,
+}
+
+// amountRule matches every operation of at least min_amount
+type amountRule struct{}
+
+func newAmountRule(fraudRuleConfig) (fraudRule, error) {
+	return amountRule{}, nil
+}
+
+func (amountRule) match(*gorm.DB, *fraudSignal) (bool, error) {
+	return true, nil
+}
+
+// velocityRule matches when the account would make more than max_count operations within window
+type velocityRule struct {
+	window   time.Duration
+	maxCount int64
+}
+
+func newVelocityRule(cfg fraudRuleConfig) (fraudRule, error) {
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid window %q", cfg.Window)
+	}
+	return velocityRule{window: window, maxCount: cfg.MaxCount}, nil
+}
+
+func (r velocityRule) match(db *gorm.DB, s *fraudSignal) (bool, error) {
+	var count int64
+	err := db.Model(&model.Transaction{}).
+		Where("account_id = ? AND transaction_type = ? AND transaction_date >= ?",
+			s.AccountID, fraudOperationTypes[s.Operation], time.Now().Add(-r.window)).
+		Count(&count).Error
+	return count+1 > r.maxCount, err
+}
+
+// firstTimeRecipientRule matches transfers to an account never paid before.
+// Moves to the login's own wallets are never a new recipient.
+type firstTimeRecipientRule struct{}
+
+func newFirstTimeRecipientRule(fraudRuleConfig) (fraudRule, error) {
+	return firstTimeRecipientRule{}, nil
+}
+
+func (firstTimeRecipientRule) match(db *gorm.DB, s *fraudSignal) (bool, error) {
+	if s.TargetAccountID == nil || s.Operation == model.FraudOperationInternalTransfer {
+		return false, nil
+	}
+
+	var count int64
+	err := db.Model(&model.Transaction{}).
+		Where("account_id = ? AND transaction_type = ? AND to_account_id = ?",
+			s.AccountID, model.TransactionTypeTransferOut, *s.TargetAccountID).
+		Count(&count).Error
+	return count == 0, err
+}
+
+// unusualAmountRule matches amounts over multiplier times the average of the recent history.
+// Accounts without history never match.
+type unusualAmountRule struct {
+	multiplier float64
+	history    int
+}
+
+func newUnusualAmountRule(cfg fraudRuleConfig) (fraudRule, error) {
+	r := unusualAmountRule{multiplier: cfg.Multiplier, history: cfg.History}
+	if r.multiplier == 0 {
+		r.multiplier = 3
+	}
+	if r.history == 0 {
+		r.history = 10
+	}
+	if r.multiplier < 1 || r.history < 0 {
+		return nil, fmt.Errorf("invalid multiplier or history")
+	}
+	return r, nil
+}
+
+func (r unusualAmountRule) match(db *gorm.DB, s *fraudSignal) (bool, error) {
+	var average *float64
+	recent := db.Model(&model.Transaction{}).
+		Select("ABS(amount) AS amount").
+		Where("account_id = ? AND transaction_type = ?", s.AccountID, fraudOperationTypes[s.Operation]).
+		Order("transaction_date DESC").
+		Limit(r.history)
+	if err := db.Table("(?) AS recent", recent).Select("AVG(amount)").Scan(&average).Error; err != nil {
+		return false, err
+	}
+	if average == nil {
+		return false, nil
+	}
+	return float64(s.Amount) > *average*r.multiplier, nil
+}
+
+// newLoginRule matches operations from a login session started less than window ago
+type newLoginRule struct {
+	window time.Duration
+}
+
+func newNewLoginRule(cfg fraudRuleConfig) (fraudRule, error) {
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid window %q", cfg.Window)
+	}
+	return newLoginRule{window: window}, nil
+}
+
+func (r newLoginRule) match(db *gorm.DB, s *fraudSignal) (bool, error) {
+	if s.SessionID == "" {
+		return false, nil
+	}
+
+	// The session started with the first refresh token of its family
+	var started *time.Time
+	err := db.Model(&model.RefreshToken{}).
+		Select("MIN(created_at)").
+		Where("family_id = ?", s.SessionID).
+		Scan(&started).Error
+	if err != nil || started == nil {
+		return false, err
+	}
+	return time.Since(*started) < r.window, nil
+}
+
+type compiledFraudRule struct {
+	config fraudRuleConfig
+	rule   fraudRule
+}
+
+func (r *compiledFraudRule) appliesTo(s *fraudSignal) bool {
+	if s.Amount < r.config.MinAmount {
+		return false
+	}
+	if len(r.config.Operations) == 0 {
+		return true
+	}
+	for _, op := range r.config.Operations {
+		if op == s.Operation {
+			return true
+		}
+	}
+	return false
+}
+
+// FraudScreener runs the rules of a JSON rules file before money moves.
+// The file is read again when it changes, so rules are updated without a redeploy.
+type FraudScreener struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	rules   []compiledFraudRule
+}
+
+// NewFraudScreener loads the rules file at path. An empty path allows every operation.
+func NewFraudScreener(path string) (*FraudScreener, error) {
+	s := &FraudScreener{path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := loadFraudRules(path)
+	if err != nil {
+		return nil, err
+	}
+	s.modTime = info.ModTime()
+	s.rules = rules
+	return s, nil
+}
+
+func loadFraudRules(path string) ([]compiledFraudRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Rules []fraudRuleConfig `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	rules := make([]compiledFraudRule, 0, len(file.Rules))
+	for _, cfg := range file.Rules {
+		if cfg.Action != fraudActionBlock && cfg.Action != fraudActionReview {
+			return nil, fmt.Errorf("rule %q: invalid action %q", cfg.Name, cfg.Action)
+		}
+		build, ok := fraudRuleTypes[cfg.Type]
+		if !ok {
+			return nil, fmt.Errorf("rule %q: unknown type %q", cfg.Name, cfg.Type)
+		}
+		rule, err := build(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", cfg.Name, err)
+		}
+		rules = append(rules, compiledFraudRule{config: cfg, rule: rule})
+	}
+	return rules, nil
+}
+
+// currentRules reloads the rules file when it changed. A broken file keeps the previous rules.
+func (s *FraudScreener) currentRules() []compiledFraudRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		log.Println("fraud rules:", err)
+		return s.rules
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return s.rules
+	}
+
+	rules, err := loadFraudRules(s.path)
+	if err != nil {
+		log.Println("fraud rules: keeping previous rules:", err)
+		return s.rules
+	}
+	s.modTime = info.ModTime()
+	s.rules = rules
+	return s.rules
+}
+
+// screen returns block, review or an empty action and the names of the matched rules.
+// A blocking rule wins over a review rule.
+func (s *FraudScreener) screen(db *gorm.DB, signal *fraudSignal) (string, []string, error) {
+	if s == nil {
+		return "", nil, nil
+	}
+
+	action := ""
+	var matched []string
+	for _, r := range s.currentRules() {
+		if !r.appliesTo(signal) {
+			continue
+		}
+		ok, err := r.rule.match(db, signal)
+		if err != nil {
+			return "", nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		matched = append(matched, r.config.Name)
+		if r.config.Action == fraudActionBlock || action == "" {
+			action = r.config.Action
+		}
+	}
+	return action, matched, nil
+}
+
+// recordScreening runs the fraud rules and stores the review of a blocked or held
+// operation with its payload, to execute on approval. The action is empty when
+// the operation may go ahead.
+func recordScreening(db *gorm.DB, s *FraudScreener, signal *fraudSignal, payload interface{}) (string, *model.FraudReview, error) {
+	action, matched, err := s.screen(db, signal)
+	if err != nil || action == "" {
+		return "", nil, err
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", nil, err
+	}
+
+	review := model.FraudReview{
+		AccountID:       signal.AccountID,
+		AuthID:          signal.AuthID,
+		Operation:       signal.Operation,
+		Amount:          signal.Amount,
+		TargetAccountID: signal.TargetAccountID,
+		Payload:         body,
+		Rules:           strings.Join(matched, ","),
+		Status:          model.FraudReviewPending,
+	}
+	if action == fraudActionBlock {
+		review.Status = model.FraudReviewBlocked
+	}
+	if err := db.Create(&review).Error; err != nil {
+		return "", nil, err
+	}
+	return action, &review, nil
+}
+
+// screenOperation runs the fraud rules for the request before it moves money.
+// It returns false when it already answered the request: the operation was
+// blocked, or queued for review and the payload stored to execute on approval.
+func screenOperation(c *gin.Context, db *gorm.DB, s *FraudScreener, signal fraudSignal, payload interface{}) bool {
+	signal.AuthID = c.GetInt64("auth_id")
+	signal.SessionID = c.GetString("session_id")
+
+	action, review, err := recordScreening(db, s, &signal, payload)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if action == "" {
+		return true
+	}
+
+	if action == fraudActionBlock {
+		abortWithError(c, errFraudBlocked)
+		return false
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Waiting for review",
+		"code":    "FRAUD_REVIEW",
+		"data":    review,
+	})
+	return false
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errReviewNotFound   = newHTTPError(http.StatusNotFound, "REVIEW_NOT_FOUND", "Not found")
+	errReviewNotPending = newHTTPError(http.StatusConflict, "REVIEW_NOT_PENDING", "Review was already decided")
+)
+
+type FraudReviewInterface interface {
+	List(*gin.Context)
+	Approve(*gin.Context)
+	Reject(*gin.Context)
+}
+
+type fraudReviewImplement struct {
+	db     *gorm.DB
+	config AccountConfig
+}
+
+func NewFraudReview(db *gorm.DB, config AccountConfig) FraudReviewInterface {
+	return &fraudReviewImplement{
+		db:     db,
+		config: config,
+	}
+}
+
+type reviewDecisionPayload struct {
+	Note string `json:"note"`
+}
+
+// List shows the review queue, pending reviews by default
+func (f *fraudReviewImplement) List(c *gin.Context) {
+	reviews := []model.FraudReview{}
+	query := f.db.Where("status = ?", c.DefaultQuery("status", model.FraudReviewPending)).
+		Order("fraud_review_id")
+	if accountID := c.Query("account_id"); accountID != "" {
+		query = query.Where("account_id = ?", accountID)
+	}
+	if err := query.Find(&reviews).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": reviews})
+}
+
+// lockPendingReview selects a pending review FOR UPDATE, so it is decided only once
+func lockPendingReview(tx *gorm.DB, id string) (*model.FraudReview, error) {
+	var review model.FraudReview
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("fraud_review_id = ?", id).
+		Take(&review).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, errReviewNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if review.Status != model.FraudReviewPending {
+		return nil, errReviewNotPending
+	}
+	return &review, nil
+}
+
+// Approve executes the held operation. When it fails, for example on
+// insufficient balance, the review stays pending and can be rejected.
+func (f *fraudReviewImplement) Approve(c *gin.Context) {
+	// The note is optional, so is the body
+	payload := reviewDecisionPayload{}
+	if err := c.ShouldBindJSON(&payload); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var review *model.FraudReview
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		review, err = lockPendingReview(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		transaction, err := f.execute(tx, review)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		reviewer := c.GetInt64("auth_id")
+		review.Status = model.FraudReviewApproved
+		review.ReviewedBy = &reviewer
+		review.ReviewNote = payload.Note
+		review.ReviewedAt = &now
+		review.TransactionID = &transaction.TransactionID
+		return tx.Save(review).Error
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Review approved",
+		"data":    review,
+	})
+}
+
+// execute runs the stored operation without screening it again
+func (f *fraudReviewImplement) execute(tx *gorm.DB, review *model.FraudReview) (*model.Transaction, error) {
+	switch review.Operation {
+	case model.FraudOperationTopup:
+		return executeTopup(tx, review.AccountID, review.Amount, f.config)
+
+	case model.FraudOperationTransfer:
+		transactions, err := executeTransfer(tx, transferRequest{
+			FromAccountID: review.AccountID,
+			ToAccountID:   *review.TargetAccountID,
+			Amount:        review.Amount,
+			Fee:           f.config.TransferFee,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &transactions[0], nil
+
+	case model.FraudOperationInternalTransfer:
+		// Like MoveBetweenWallets: no fee and no limits
+		transactions, err := executeTransfer(tx, transferRequest{
+			FromAccountID: review.AccountID,
+			ToAccountID:   *review.TargetAccountID,
+			Amount:        review.Amount,
+			Internal:      true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &transactions[0], nil
+
+	case model.FraudOperationTransaction:
+		// Only the fields of a manual transaction are read from the stored request
+		var payload manualTransactionPayload
+		if err := json.Unmarshal(review.Payload, &payload); err != nil {
+			return nil, err
+		}
+		transaction := payload.transaction(review.AccountID)
+
+		// The account may have been frozen or suspended while the review was pending
+		accounts, err := lockAccounts(tx, review.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		account, ok := accounts[review.AccountID]
+		if !ok {
+			return nil, errAccountClosed
+		}
+		if err := checkActive(account); err != nil {
+			return nil, err
+		}
+		if err := tx.Create(&transaction).Error; err != nil {
+			return nil, err
+		}
+		if err := notifyTransactions(tx, transaction); err != nil {
+			return nil, err
+		}
+		return &transaction, nil
+	}
+
+	return nil, newHTTPError(http.StatusBadRequest, "INVALID_OPERATION", "Unknown operation "+review.Operation)
+}
+
+// Reject drops the held operation, nothing is executed
+func (f *fraudReviewImplement) Reject(c *gin.Context) {
+	// The note is optional, so is the body
+	payload := reviewDecisionPayload{}
+	if err := c.ShouldBindJSON(&payload); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var review *model.FraudReview
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		review, err = lockPendingReview(tx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		reviewer := c.GetInt64("auth_id")
+		review.Status = model.FraudReviewRejected
+		review.ReviewedBy = &reviewer
+		review.ReviewNote = payload.Note
+		review.ReviewedAt = &now
+		return tx.Save(review).Error
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Review rejected",
+		"data":    review,
+	})
+}
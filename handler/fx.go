@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"task-golang-db/model"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type FxInterface interface {
+	SetRate(*gin.Context)
+	List(*gin.Context)
+}
+
+type fxImplement struct {
+	db *gorm.DB
+}
+
+func NewFx(db *gorm.DB) FxInterface {
+	return &fxImplement{
+		db: db,
+	}
+}
+
+// fxRateDecimals is the precision rates are stored with, numeric(24, 12)
+const fxRateDecimals = 12
+
+var fxRateUnit = new(big.Int).Exp(big.NewInt(10), big.NewInt(fxRateDecimals), nil)
+
+// parseRate reads a decimal rate exactly, without going through float64
+func parseRate(s string) (*big.Rat, error) {
+	rate, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
+
+// truncateRate rounds a rate down to fxRateDecimals so it can be stored as is
+func truncateRate(rate *big.Rat) *big.Rat {
+	scaled := new(big.Int).Mul(rate.Num(), fxRateUnit)
+	scaled.Quo(scaled, rate.Denom())
+	return new(big.Rat).SetFrac(scaled, fxRateUnit)
+}
+
+// formatRate is the stored form of a rate that was truncated with truncateRate
+func formatRate(rate *big.Rat) string {
+	return rate.FloatString(fxRateDecimals)
+}
+
+// fxQuote returns the rate converting amounts in from into to. When only the
+// opposite pair is quoted its inverse is used, rounded down to the stored
+// precision so the rate recorded on a transaction is exactly the one applied.
+func fxQuote(db *gorm.DB, from, to string) (*big.Rat, error) {
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+
+	var rate model.FxRate
+	err := db.Where("base_currency = ? AND quote_currency = ?", from, to).First(&rate).Error
+	if err == nil {
+		return parseRate(rate.Rate)
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	err = db.Where("base_currency = ? AND quote_currency = ?", to, from).First(&rate).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, newHTTPError(http.StatusBadRequest, "FX_RATE_UNAVAILABLE",
+			fmt.Sprintf("No exchange rate from %s to %s", from, to))
+	}
+	if err != nil {
+		return nil, err
+	}
+	inverse, err := parseRate(rate.Rate)
+	if err != nil {
+		return nil, err
+	}
+	return truncateRate(inverse.Inv(inverse)), nil
+}
+
+var errAmountTooLarge = newHTTPError(http.StatusBadRequest, "AMOUNT_TOO_LARGE", "Converted amount is too large")
+
+// convertAmount converts a non-negative amount at the given rate, rounding down
+// to the smallest unit of the target currency
+func convertAmount(amount int64, rate *big.Rat) (int64, error) {
+	converted := new(big.Int).Mul(big.NewInt(amount), rate.Num())
+	converted.Div(converted, rate.Denom())
+	if !converted.IsInt64() {
+		return 0, errAmountTooLarge
+	}
+	return converted.Int64(), nil
+}
+
+type fxRatePayload struct {
+	BaseCurrency  string      `json:"base_currency"`
+	QuoteCurrency string      `json:"quote_currency"`
+	Rate          json.Number `json:"rate"`
+}
+
+func (f *fxImplement) SetRate(c *gin.Context) {
+	payload := fxRatePayload{}
+
+	// bind JSON Request to payload
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !model.IsSupportedCurrency(payload.BaseCurrency) || !model.IsSupportedCurrency(payload.QuoteCurrency) ||
+		payload.BaseCurrency == payload.QuoteCurrency {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid currency pair"})
+		return
+	}
+	// The rate must fit numeric(24, 12) exactly, it is never rounded silently
+	value, err := parseRate(payload.Rate.String())
+	if err != nil || value.Sign() <= 0 || truncateRate(value).Cmp(value) != 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid rate"})
+		return
+	}
+
+	// Insert or replace the quote of the pair
+	rate := model.FxRate{
+		BaseCurrency:  payload.BaseCurrency,
+		QuoteCurrency: payload.QuoteCurrency,
+		Rate:          formatRate(value),
+		UpdatedBy:     c.GetInt64("auth_id"),
+	}
+	if err := f.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "base_currency"}, {Name: "quote_currency"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rate", "updated_by", "updated_at"}),
+	}).Create(&rate).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auditChange(c, "fx.set_rate", "fx_rate", payload.BaseCurrency+"/"+payload.QuoteCurrency, nil, snapshot(rate))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Rate saved",
+		"data":    rate,
+	})
+}
+
+func (f *fxImplement) List(c *gin.Context) {
+	rates := []model.FxRate{}
+	if err := f.db.Order("base_currency, quote_currency").Find(&rates).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": rates})
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"math"
+	"testing"
+)
+
+func TestConvertAmount(t *testing.T) {
+	tests := []struct {
+		amount int64
+		rate   string
+		want   int64
+	}{
+		{100, "15500", 1550000},
+		{3, "0.1", 0}, // 0.3 rounds down
+		{10, "0.1", 1},
+		{1550000, "0.000064516129", 99}, // 99.99999995 rounds down
+		{100000000000, "0.1", 10000000000},
+	}
+	for _, tt := range tests {
+		rate, err := parseRate(tt.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := convertAmount(tt.amount, rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("convertAmount(%d, %s) = %d, want %d", tt.amount, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestConvertAmountTooLarge(t *testing.T) {
+	rate, err := parseRate("16000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := convertAmount(math.MaxInt64/1000, rate); err != errAmountTooLarge {
+		t.Errorf("err = %v, want errAmountTooLarge", err)
+	}
+}
+
+func TestTruncateRateInverse(t *testing.T) {
+	rate, err := parseRate("15500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inverse := truncateRate(rate.Inv(rate))
+	if got := formatRate(inverse); got != "0.000064516129" {
+		t.Errorf("inverse = %s, want 0.000064516129", got)
+	}
+	// The stored form reads back as exactly the applied rate
+	stored, err := parseRate(formatRate(inverse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Cmp(inverse) != 0 {
+		t.Errorf("stored rate %s differs from applied %s", stored, inverse)
+	}
+}
@@ -0,0 +1,352 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultHoldTTL  = 7 * 24 * time.Hour
+	holdExpiryBatch = 100
+)
+
+var (
+	errHoldNotFound  = newHTTPError(http.StatusNotFound, "HOLD_NOT_FOUND", "Not found")
+	errHoldNotActive = newHTTPError(http.StatusConflict, "HOLD_NOT_ACTIVE", "Hold is no longer authorized")
+	errHoldExceeded  = newHTTPError(http.StatusBadRequest, "CAPTURE_EXCEEDS_HOLD", "Capture is more than the held amount")
+)
+
+type HoldInterface interface {
+	Authorize(*gin.Context)
+	Capture(*gin.Context)
+	Void(*gin.Context)
+	List(*gin.Context)
+}
+
+type holdImplement struct {
+	db     *gorm.DB
+	config AccountConfig
+	fraud  *FraudScreener
+}
+
+func NewHold(db *gorm.DB, config AccountConfig, fraud *FraudScreener) HoldInterface {
+	return &holdImplement{
+		db:     db,
+		config: config,
+		fraud:  fraud,
+	}
+}
+
+// adjustHeld changes the held balance of a locked account
+func adjustHeld(tx *gorm.DB, accountID, delta int64) error {
+	err := tx.Model(&model.Account{}).Where("account_id = ?", accountID).
+		Update("held_balance", gorm.Expr("held_balance + ?", delta)).Error
+	if err != nil {
+		return err
+	}
+
+	// The available balance changed
+	return model.NotifyAccountEvent(tx, accountID, model.AccountEventBalance, nil)
+}
+
+// lockHold selects an authorized hold FOR UPDATE, the sender or the target can act on it.
+// Holds are always locked before their accounts.
+func lockHold(tx *gorm.DB, holdID string, accountID int64) (*model.Hold, error) {
+	var hold model.Hold
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("hold_id = ? AND (account_id = ? OR target_account_id = ?)", holdID, accountID, accountID).
+		Take(&hold).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, errHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hold.Status != model.HoldAuthorized || !hold.ExpiresAt.After(time.Now()) {
+		return nil, errHoldNotActive
+	}
+	return &hold, nil
+}
+
+// releaseHold gives the reserved amount back to the available balance and closes the hold
+func releaseHold(tx *gorm.DB, hold *model.Hold, status string) error {
+	if _, err := lockAccounts(tx, hold.AccountID); err != nil {
+		return err
+	}
+	if err := adjustHeld(tx, hold.AccountID, -hold.Reserved()); err != nil {
+		return err
+	}
+
+	hold.Status = status
+	return tx.Save(hold).Error
+}
+
+func (h *holdImplement) Authorize(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+	var payload struct {
+		TargetAccountID  int64 `json:"target_account_id"`
+		Amount           int64 `json:"amount"`
+		ExpiresInMinutes int64 `json:"expires_in_minutes"`
+	}
+
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if payload.Amount <= 0 || payload.TargetAccountID == accountID || payload.ExpiresInMinutes < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid hold request"})
+		return
+	}
+
+	ttl := defaultHoldTTL
+	if payload.ExpiresInMinutes > 0 {
+		ttl = time.Duration(payload.ExpiresInMinutes) * time.Minute
+	}
+
+	// A hold is a transfer settled later, the capture is not screened again.
+	// A held authorization is approved as the transfer it would settle.
+	if !screenOperation(c, h.db, h.fraud, fraudSignal{
+		Operation:       model.FraudOperationTransfer,
+		AccountID:       accountID,
+		Amount:          payload.Amount,
+		TargetAccountID: &payload.TargetAccountID,
+	}, payload) {
+		return
+	}
+
+	var hold model.Hold
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		accounts, err := lockAccounts(tx, accountID, payload.TargetAccountID)
+		if err != nil {
+			return err
+		}
+		sender, ok := accounts[accountID]
+		if !ok {
+			return errSenderNotFound
+		}
+		target, ok := accounts[payload.TargetAccountID]
+		if !ok || target.SystemCode != nil {
+			return errTargetNotFound
+		}
+		if err := checkCanSend(sender, false); err != nil {
+			return err
+		}
+		if err := checkCanReceive(target); err != nil {
+			return err
+		}
+
+		// Limited like the transfer it settles, the capture is not limited again
+		if err := checkLimit(tx, sender, model.LimitTransfer, payload.Amount); err != nil {
+			return err
+		}
+
+		hold = model.Hold{
+			AccountID:       accountID,
+			TargetAccountID: payload.TargetAccountID,
+			Amount:          payload.Amount,
+			Fee:             h.config.TransferFee,
+			Status:          model.HoldAuthorized,
+			ExpiresAt:       time.Now().Add(ttl),
+		}
+
+		// Reserve the fee too from what is still available, so a full capture can always settle
+		if sender.Available() < hold.Reserved() {
+			return errInsufficientBalance
+		}
+		if err := adjustHeld(tx, accountID, hold.Reserved()); err != nil {
+			return err
+		}
+		return tx.Create(&hold).Error
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Hold authorized",
+		"data":    hold,
+	})
+}
+
+func (h *holdImplement) Capture(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+	var payload struct {
+		Amount int64 `json:"amount"` // zero captures the full hold
+	}
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if payload.Amount < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid capture amount"})
+		return
+	}
+
+	var hold *model.Hold
+	var transactions []model.Transaction
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		hold, err = lockHold(tx, c.Param("id"), accountID)
+		if err != nil {
+			return err
+		}
+
+		// Both accounts in id order before anything else, like every transfer
+		if _, err := lockAccounts(tx, hold.AccountID, hold.TargetAccountID); err != nil {
+			return err
+		}
+
+		amount := payload.Amount
+		if amount == 0 {
+			amount = hold.Amount
+		}
+		if amount > hold.Amount {
+			return errHoldExceeded
+		}
+
+		// A capture closes the hold, what is not captured goes back to available
+		if err := releaseHold(tx, hold, model.HoldCaptured); err != nil {
+			return err
+		}
+
+		transactions, err = executeTransfer(tx, transferRequest{
+			FromAccountID: hold.AccountID,
+			ToAccountID:   hold.TargetAccountID,
+			Amount:        amount,
+			Fee:           hold.Fee,
+			Settling:      true,
+			Captured:      true,
+		})
+		if err != nil {
+			return err
+		}
+
+		hold.CapturedAmount = amount
+		hold.JournalEntryID = transactions[0].JournalEntryID
+		return tx.Save(hold).Error
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Hold captured",
+		"data":    hold,
+	})
+}
+
+func (h *holdImplement) Void(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	var hold *model.Hold
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		hold, err = lockHold(tx, c.Param("id"), accountID)
+		if err != nil {
+			return err
+		}
+		return releaseHold(tx, hold, model.HoldVoided)
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Hold voided",
+		"data":    hold,
+	})
+}
+
+func (h *holdImplement) List(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	// Holds I placed and holds placed in my favour
+	holds := []model.Hold{}
+	query := h.db.Where("account_id = ? OR target_account_id = ?", accountID, accountID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Order("hold_id DESC").Find(&holds).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": holds})
+}
+
+// HoldExpirer releases holds that were neither captured nor voided before they expired
+type HoldExpirer struct {
+	db       *gorm.DB
+	interval time.Duration
+}
+
+func NewHoldExpirer(db *gorm.DB, interval time.Duration) *HoldExpirer {
+	return &HoldExpirer{
+		db:       db,
+		interval: interval,
+	}
+}
+
+// Run expires stale holds every interval until ctx is cancelled
+func (e *HoldExpirer) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.expire(); err != nil {
+			log.Println("Hold expirer:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *HoldExpirer) expire() error {
+	var holdIDs []int64
+	if err := e.db.Model(&model.Hold{}).
+		Where("status = ? AND expires_at <= ?", model.HoldAuthorized, time.Now()).
+		Order("hold_id").
+		Limit(holdExpiryBatch).
+		Pluck("hold_id", &holdIDs).Error; err != nil {
+		return err
+	}
+
+	// One transaction per hold, each locks only one hold and its account,
+	// so the expirer never holds locks that a capture or transfer waits on in another order
+	for _, holdID := range holdIDs {
+		if err := e.db.Transaction(func(tx *gorm.DB) error {
+			var hold model.Hold
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+				Where("hold_id = ? AND status = ? AND expires_at <= ?", holdID, model.HoldAuthorized, time.Now()).
+				Take(&hold).Error
+			if err == gorm.ErrRecordNotFound {
+				// Captured, voided or being settled meanwhile
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return releaseHold(tx, &hold, model.HoldExpired)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"task-golang-db/model"
+
+	"gorm.io/gorm"
+)
+
+// errImportRollback undoes an import that was a dry run or had invalid rows
+var errImportRollback = errors.New("import rolled back")
+
+type importRowResult struct {
+	Row         int                `json:"row"`
+	Status      string             `json:"status"`
+	Error       string             `json:"error,omitempty"`
+	Transaction *model.Transaction `json:"transaction,omitempty"`
+}
+
+type importReport struct {
+	DryRun            bool                        `json:"dry_run"`
+	Imported          int                         `json:"imported"`
+	Failed            int                         `json:"failed"`
+	CreatedCategories []model.TransactionCategory `json:"created_categories"`
+	Rows              []importRowResult           `json:"rows"`
+}
+
+type transactionImporter struct {
+	tx               *gorm.DB
+	accountID        int64
+	createCategories bool
+	columns          map[string]int
+	categories       map[string]*model.TransactionCategory
+	report           *importReport
+}
+
+// importTransactions reads manual transactions from CSV with the columns transaction_date,
+// amount and optionally category, from_account_id and to_account_id. Either every row
+// is imported or none, a dry run validates everything and always rolls back.
+func importTransactions(db *gorm.DB, accountID int64, r io.Reader, dryRun, createCategories bool) (*importReport, error) {
+	report := &importReport{
+		DryRun:            dryRun,
+		CreatedCategories: []model.TransactionCategory{},
+		Rows:              []importRowResult{},
+	}
+
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"transaction_date", "amount"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("missing column %s", required)
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		im := transactionImporter{
+			tx:               tx,
+			accountID:        accountID,
+			createCategories: createCategories,
+			columns:          columns,
+			categories:       map[string]*model.TransactionCategory{},
+			report:           report,
+		}
+
+		for row := 2; ; row++ { // row 1 is the header
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				// The rest of the file can't be trusted, the import fails
+				report.Rows = append(report.Rows, importRowResult{Row: row, Status: "error", Error: err.Error()})
+				report.Failed++
+				break
+			}
+
+			result := importRowResult{Row: row, Status: "ok"}
+			result.Transaction, err = im.importRow(record)
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+				report.Failed++
+			} else {
+				report.Imported++
+			}
+			report.Rows = append(report.Rows, result)
+		}
+
+		if dryRun || report.Failed > 0 {
+			return errImportRollback
+		}
+		return nil
+	})
+	if err != nil && err != errImportRollback {
+		return nil, err
+	}
+
+	// Nothing was written
+	if report.Failed > 0 {
+		report.Imported = 0
+	}
+
+	return report, nil
+}
+
+func (im *transactionImporter) field(record []string, name string) string {
+	i, ok := im.columns[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+func (im *transactionImporter) optionalID(record []string, name string) (*int64, error) {
+	s := im.field(record, name)
+	if s == "" {
+		return nil, nil
+	}
+
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s", name)
+	}
+	return &id, nil
+}
+
+func (im *transactionImporter) importRow(record []string) (*model.Transaction, error) {
+	date, err := parseDate(im.field(record, "transaction_date"), false)
+	if err != nil {
+		return nil, errors.New("invalid transaction_date")
+	}
+
+	amount, err := strconv.ParseInt(im.field(record, "amount"), 10, 64)
+	if err != nil || amount == 0 {
+		return nil, errors.New("invalid amount")
+	}
+
+	transaction := model.Transaction{
+		AccountID:       im.accountID,
+		Amount:          amount,
+		TransactionDate: *date,
+		TransactionType: model.TransactionTypeManual,
+	}
+	if transaction.FromAccountID, err = im.optionalID(record, "from_account_id"); err != nil {
+		return nil, err
+	}
+	if transaction.ToAccountID, err = im.optionalID(record, "to_account_id"); err != nil {
+		return nil, err
+	}
+
+	if name := im.field(record, "category"); name != "" {
+		category, err := im.category(name)
+		if err != nil {
+			return nil, err
+		}
+		transaction.TransactionCategoryID = &category.ID
+	}
+
+	// A savepoint per insert, a failed row must not abort the DB transaction for the next rows
+	if err := im.tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+		return notifyTransactions(tx, transaction)
+	}); err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// category maps a category name, case insensitive, to a transaction category
+func (im *transactionImporter) category(name string) (*model.TransactionCategory, error) {
+	key := strings.ToLower(name)
+	if category, ok := im.categories[key]; ok {
+		return category, nil
+	}
+
+	category := model.TransactionCategory{}
+	// Own categories win over global ones with the same name
+	err := usableCategories(im.tx, im.accountID).
+		Where("LOWER(name) = ?", key).
+		Order("account_id NULLS LAST").
+		First(&category).Error
+	if err == gorm.ErrRecordNotFound {
+		if !im.createCategories {
+			return nil, fmt.Errorf("unknown category %q", name)
+		}
+
+		category = model.TransactionCategory{Name: name, AccountID: &im.accountID}
+		if err := im.tx.Transaction(func(tx *gorm.DB) error {
+			return tx.Create(&category).Error
+		}); err != nil {
+			return nil, err
+		}
+		im.report.CreatedCategories = append(im.report.CreatedCategories, category)
+	} else if err != nil {
+		return nil, err
+	}
+
+	im.categories[key] = &category
+	return &category, nil
+}
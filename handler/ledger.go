@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"task-golang-db/model"
+
+	"gorm.io/gorm"
+)
+
+// System account codes, the counterparties of money entering or leaving the wallet.
+// Every code has one system account per currency.
+const (
+	systemAccountCashIn    = "cash_in"
+	systemAccountFees      = "fees"
+	systemAccountReferrals = "referrals"
+	systemAccountFx        = "fx"
+)
+
+var errUnbalancedEntry = errors.New("journal entry is not balanced")
+
+// systemAccountID returns the account id of the system account with the given code
+// and currency, creating the account on first use.
+func systemAccountID(tx *gorm.DB, code, currency string) (int64, error) {
+	account := model.Account{}
+	err := tx.Where("system_code = ? AND currency = ?", code, currency).
+		Attrs(model.Account{Name: "System " + code + " " + currency, SystemCode: &code, Currency: currency}).
+		FirstOrCreate(&account).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return account.AccountID, nil
+}
+
+// postJournalEntry records a balanced journal entry and applies its postings
+// to the cached account balances. It must be called inside a DB transaction.
+// Balances are updated in account id order whatever the order of the postings,
+// so every entry takes the row locks in the same order.
+func postJournalEntry(tx *gorm.DB, entryType, description string, postings []model.Posting) (*model.JournalEntry, error) {
+	// Zero amount legs carry no information, drop them
+	legs := make([]model.Posting, 0, len(postings))
+	sums := map[string]int64{}
+	for _, p := range postings {
+		if p.Amount == 0 {
+			continue
+		}
+		sums[p.Currency] += p.Amount
+		legs = append(legs, p)
+	}
+	if len(legs) < 2 {
+		return nil, errUnbalancedEntry
+	}
+	for _, sum := range sums {
+		if sum != 0 {
+			return nil, errUnbalancedEntry
+		}
+	}
+
+	entry := model.JournalEntry{
+		EntryType:   entryType,
+		Description: description,
+		Postings:    legs,
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+
+	// Keep accounts.balance in sync with the postings. The updates lock the rows,
+	// system accounts included, so they go in account id order like lockAccounts
+	// or two entries touching the same accounts could deadlock.
+	ordered := append([]model.Posting(nil), legs...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].AccountID < ordered[j].AccountID })
+	for _, p := range ordered {
+		result := tx.Model(&model.Account{}).Where("account_id = ? AND currency = ?", p.AccountID, p.Currency).
+			Update("balance", gorm.Expr("balance + ?", p.Amount))
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil, fmt.Errorf("posting to unknown account %d in %s", p.AccountID, p.Currency)
+		}
+		if err := model.NotifyAccountEvent(tx, p.AccountID, model.AccountEventBalance, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return &entry, nil
+}
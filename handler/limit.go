@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type LimitInterface interface {
+	Set(*gin.Context)
+	List(*gin.Context)
+	My(*gin.Context)
+}
+
+type limitImplement struct {
+	db *gorm.DB
+}
+
+func NewLimit(db *gorm.DB) LimitInterface {
+	return &limitImplement{
+		db: db,
+	}
+}
+
+// limitTransactionTypes maps a limit kind to the transactions counted against it
+var limitTransactionTypes = map[string]string{
+	model.LimitTopup:    model.TransactionTypeTopup,
+	model.LimitTransfer: model.TransactionTypeTransferOut,
+}
+
+type limitUsage struct {
+	DailyCount    int64 `json:"daily_count"`
+	DailyAmount   int64 `json:"daily_amount"`
+	MonthlyCount  int64 `json:"monthly_count"`
+	MonthlyAmount int64 `json:"monthly_amount"`
+}
+
+// effectiveLimit merges the global default of the account's currency with the account's override
+func effectiveLimit(db *gorm.DB, account *model.Account, kind string) (*model.AccountLimit, error) {
+	var rows []model.AccountLimit
+	if err := db.Where("kind = ? AND currency = ? AND (account_id IS NULL OR account_id = ?)",
+		kind, account.Currency, account.AccountID).
+		Order("account_id NULLS FIRST").
+		Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	limit := model.AccountLimit{AccountID: &account.AccountID, Kind: kind, Currency: account.Currency}
+	for _, row := range rows {
+		for _, f := range []struct{ dst, src **int64 }{
+			{&limit.PerTransactionMax, &row.PerTransactionMax},
+			{&limit.DailyCount, &row.DailyCount},
+			{&limit.DailyAmount, &row.DailyAmount},
+			{&limit.MonthlyCount, &row.MonthlyCount},
+			{&limit.MonthlyAmount, &row.MonthlyAmount},
+		} {
+			if *f.src != nil {
+				*f.dst = *f.src
+			}
+		}
+	}
+	return &limit, nil
+}
+
+// usageOf counts the account's transactions of the kind today and this month.
+// Topups and outgoing transfer legs are always in the account's currency.
+// Authorized holds are transfers to come, they count until captured or released.
+func usageOf(db *gorm.DB, accountID int64, kind string) (*limitUsage, error) {
+	now := time.Now()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	usage := limitUsage{}
+	err := db.Model(&model.Transaction{}).
+		Select(`COUNT(*) FILTER (WHERE transaction_date >= @day) AS daily_count,
+			COALESCE(SUM(ABS(amount)) FILTER (WHERE transaction_date >= @day), 0) AS daily_amount,
+			COUNT(*) AS monthly_count,
+			COALESCE(SUM(ABS(amount)), 0) AS monthly_amount`, map[string]interface{}{"day": dayStart}).
+		Where("account_id = ? AND transaction_type = ? AND transaction_date >= ?",
+			accountID, limitTransactionTypes[kind], monthStart).
+		Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == model.LimitTransfer {
+		held := limitUsage{}
+		err := db.Model(&model.Hold{}).
+			Select(`COUNT(*) FILTER (WHERE created_at >= @day) AS daily_count,
+				COALESCE(SUM(amount) FILTER (WHERE created_at >= @day), 0) AS daily_amount,
+				COUNT(*) AS monthly_count,
+				COALESCE(SUM(amount), 0) AS monthly_amount`, map[string]interface{}{"day": dayStart}).
+			Where("account_id = ? AND status = ? AND created_at >= ?", accountID, model.HoldAuthorized, monthStart).
+			Scan(&held).Error
+		if err != nil {
+			return nil, err
+		}
+		usage.DailyCount += held.DailyCount
+		usage.DailyAmount += held.DailyAmount
+		usage.MonthlyCount += held.MonthlyCount
+		usage.MonthlyAmount += held.MonthlyAmount
+	}
+	return &usage, nil
+}
+
+func limitExceeded(code, message string, limit, remaining int64) error {
+	return &httpError{
+		status:  http.StatusUnprocessableEntity,
+		code:    code,
+		message: message,
+		details: gin.H{"limit": limit, "remaining": remaining},
+	}
+}
+
+// checkLimit fails when amount, in the account's currency, would go over one of the
+// account's limits of the kind. The account must be locked so concurrent requests
+// are counted correctly.
+func checkLimit(tx *gorm.DB, account *model.Account, kind string, amount int64) error {
+	limit, err := effectiveLimit(tx, account, kind)
+	if err != nil {
+		return err
+	}
+
+	if limit.PerTransactionMax != nil && amount > *limit.PerTransactionMax {
+		return limitExceeded("LIMIT_PER_TRANSACTION", "Amount is over the per transaction limit",
+			*limit.PerTransactionMax, *limit.PerTransactionMax)
+	}
+
+	usage, err := usageOf(tx, account.AccountID, kind)
+	if err != nil {
+		return err
+	}
+
+	checks := []struct {
+		max       *int64
+		used, add int64
+		code      string
+		message   string
+	}{
+		{limit.DailyCount, usage.DailyCount, 1, "LIMIT_DAILY_COUNT", "Daily number of transactions reached"},
+		{limit.DailyAmount, usage.DailyAmount, amount, "LIMIT_DAILY_AMOUNT", "Amount is over the daily limit"},
+		{limit.MonthlyCount, usage.MonthlyCount, 1, "LIMIT_MONTHLY_COUNT", "Monthly number of transactions reached"},
+		{limit.MonthlyAmount, usage.MonthlyAmount, amount, "LIMIT_MONTHLY_AMOUNT", "Amount is over the monthly limit"},
+	}
+	for _, check := range checks {
+		if check.max != nil && check.used+check.add > *check.max {
+			return limitExceeded(check.code, check.message, *check.max, max(*check.max-check.used, 0))
+		}
+	}
+	return nil
+}
+
+type limitPayload struct {
+	AccountID         *int64 `json:"account_id"` // empty sets the global default
+	Kind              string `json:"kind"`
+	Currency          string `json:"currency"` // defaults to the account's currency
+	PerTransactionMax *int64 `json:"per_transaction_max"`
+	DailyCount        *int64 `json:"daily_count"`
+	DailyAmount       *int64 `json:"daily_amount"`
+	MonthlyCount      *int64 `json:"monthly_count"`
+	MonthlyAmount     *int64 `json:"monthly_amount"`
+}
+
+// Set replaces the global or per account limits of a kind, for admins only
+func (l *limitImplement) Set(c *gin.Context) {
+	payload := limitPayload{}
+
+	// bind JSON Request to payload
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, ok := limitTransactionTypes[payload.Kind]; !ok {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid kind, expected topup or transfer"})
+		return
+	}
+
+	// An account's limits are in its own currency, global defaults exist per currency
+	if payload.AccountID != nil {
+		var account model.Account
+		if err := l.db.Select("currency").First(&account, *payload.AccountID).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Account not found"})
+			return
+		}
+		if payload.Currency == "" {
+			payload.Currency = account.Currency
+		}
+		if payload.Currency != account.Currency {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Currency must be the account's currency"})
+			return
+		}
+	}
+	if payload.Currency == "" {
+		payload.Currency = model.DefaultCurrency
+	}
+	if !model.IsSupportedCurrency(payload.Currency) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+		return
+	}
+
+	limit := model.AccountLimit{}
+	var before json.RawMessage
+	err := l.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("kind = ? AND currency = ?", payload.Kind, payload.Currency)
+		if payload.AccountID == nil {
+			query = query.Where("account_id IS NULL")
+		} else {
+			query = query.Where("account_id = ?", *payload.AccountID)
+		}
+		if err := query.First(&limit).Error; err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		if limit.AccountLimitID != 0 {
+			before = snapshot(limit)
+		}
+
+		limit.AccountID = payload.AccountID
+		limit.Kind = payload.Kind
+		limit.Currency = payload.Currency
+		limit.PerTransactionMax = payload.PerTransactionMax
+		limit.DailyCount = payload.DailyCount
+		limit.DailyAmount = payload.DailyAmount
+		limit.MonthlyCount = payload.MonthlyCount
+		limit.MonthlyAmount = payload.MonthlyAmount
+		return tx.Save(&limit).Error
+	})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	auditChange(c, "limit.set", "account_limit", limit.AccountLimitID, before, snapshot(limit))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Limit saved",
+		"data":    limit,
+	})
+}
+
+func (l *limitImplement) List(c *gin.Context) {
+	limits := []model.AccountLimit{}
+	query := l.db.Order("account_id NULLS FIRST, kind, currency")
+	if accountID := c.Query("account_id"); accountID != "" {
+		query = query.Where("account_id IS NULL OR account_id = ?", accountID)
+	}
+	if currency := c.Query("currency"); currency != "" {
+		query = query.Where("currency = ?", currency)
+	}
+	if err := query.Find(&limits).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": limits})
+}
+
+// My shows the limits that apply to the acting account and what was used of them
+func (l *limitImplement) My(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	var account model.Account
+	if err := l.db.Select("account_id", "currency").First(&account, accountID).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result := gin.H{}
+	for _, kind := range []string{model.LimitTopup, model.LimitTransfer} {
+		limit, err := effectiveLimit(l.db, &account, kind)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		usage, err := usageOf(l.db, accountID, kind)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result[kind] = gin.H{
+			"limit": limit,
+			"used":  usage,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": result})
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageSize = 10
+	maxPageSize     = 100
+)
+
+// transactionCursor points at the last transaction of a page,
+// transactions are ordered by transaction_date then transaction_id, newest first.
+type transactionCursor struct {
+	Date time.Time
+	ID   int64
+}
+
+func (tc transactionCursor) encode() string {
+	raw := fmt.Sprintf("%d:%d", tc.Date.UnixNano(), tc.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeTransactionCursor(s string) (*transactionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var nanos, id int64
+	if _, err := fmt.Sscanf(string(raw), "%d:%d", &nanos, &id); err != nil {
+		return nil, err
+	}
+
+	// transaction_date has no time zone, it is read back as UTC. A Local
+	// time would be sent with its wall clock and shift by the UTC offset.
+	return &transactionCursor{Date: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+// transactionFilter holds the query string filters shared by the transaction history endpoints
+type transactionFilter struct {
+	From       *time.Time
+	To         *time.Time
+	MinAmount  *int64
+	MaxAmount  *int64
+	CategoryID *int64
+	Direction  string
+	Limit      int
+	Cursor     *transactionCursor
+}
+
+func invalidFilter(name string) error {
+	return newHTTPError(http.StatusBadRequest, "INVALID_FILTER", "Invalid "+name)
+}
+
+// parseDate accepts YYYY-MM-DD or RFC3339, endOfDay moves a plain date to the start of the next day
+func parseDate(s string, endOfDay bool) (*time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return &t, nil
+	}
+
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+func parseInt64Query(c *gin.Context, name string) (*int64, error) {
+	s := c.Query(name)
+	if s == "" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, invalidFilter(name)
+	}
+	return &v, nil
+}
+
+// parseTransactionFilter reads from, to, min_amount, max_amount, category_id,
+// direction (in/out), limit and cursor from the query string.
+func parseTransactionFilter(c *gin.Context) (transactionFilter, error) {
+	var err error
+	f := transactionFilter{Limit: defaultPageSize}
+
+	if s := c.Query("from"); s != "" {
+		if f.From, err = parseDate(s, false); err != nil {
+			return f, invalidFilter("from")
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		if f.To, err = parseDate(s, true); err != nil {
+			return f, invalidFilter("to")
+		}
+	}
+	if f.MinAmount, err = parseInt64Query(c, "min_amount"); err != nil {
+		return f, err
+	}
+	if f.MaxAmount, err = parseInt64Query(c, "max_amount"); err != nil {
+		return f, err
+	}
+	if f.CategoryID, err = parseInt64Query(c, "category_id"); err != nil {
+		return f, err
+	}
+
+	f.Direction = strings.ToLower(c.Query("direction"))
+	if f.Direction != "" && f.Direction != "in" && f.Direction != "out" {
+		return f, invalidFilter("direction")
+	}
+
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return f, invalidFilter("limit")
+		}
+		f.Limit = min(limit, maxPageSize)
+	}
+
+	if s := c.Query("cursor"); s != "" {
+		if f.Cursor, err = decodeTransactionCursor(s); err != nil {
+			return f, invalidFilter("cursor")
+		}
+	}
+
+	return f, nil
+}
+
+// apply adds the filters, without paging, to a query on the transaction table.
+// Amounts are compared by absolute value, direction is given by the sign.
+func (f transactionFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.From != nil {
+		query = query.Where("transaction_date >= ?", *f.From)
+	}
+	if f.To != nil {
+		query = query.Where("transaction_date < ?", *f.To)
+	}
+	if f.MinAmount != nil {
+		query = query.Where("ABS(amount) >= ?", *f.MinAmount)
+	}
+	if f.MaxAmount != nil {
+		query = query.Where("ABS(amount) <= ?", *f.MaxAmount)
+	}
+	if f.CategoryID != nil {
+		query = query.Where("transaction_category_id = ?", *f.CategoryID)
+	}
+	switch f.Direction {
+	case "in":
+		query = query.Where("amount > 0")
+	case "out":
+		query = query.Where("amount < 0")
+	}
+
+	return query
+}
+
+// findTransactionPage returns one page of the account's transactions, newest first,
+// and the cursor of the next page which is empty on the last page.
+func findTransactionPage(db *gorm.DB, accountID int64, f transactionFilter) ([]model.Transaction, string, error) {
+	query := f.apply(db.Where("account_id = ?", accountID))
+	if f.Cursor != nil {
+		query = query.Where("(transaction_date, transaction_id) < (?, ?)", f.Cursor.Date, f.Cursor.ID)
+	}
+
+	// Fetch one extra row to know whether there is a next page
+	transactions := []model.Transaction{}
+	if err := query.Order("transaction_date DESC, transaction_id DESC").
+		Limit(f.Limit + 1).
+		Find(&transactions).Error; err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if len(transactions) > f.Limit {
+		transactions = transactions[:f.Limit]
+		last := transactions[len(transactions)-1]
+		nextCursor = transactionCursor{Date: last.TransactionDate, ID: last.TransactionID}.encode()
+	}
+
+	// Show how much of each transaction was reversed
+	if err := fillReversedAmounts(db, transactions); err != nil {
+		return nil, "", err
+	}
+
+	return transactions, nextCursor, nil
+}
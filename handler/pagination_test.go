@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransactionCursorRoundTrip(t *testing.T) {
+	// Dates come back from the transaction_date column in UTC
+	want := transactionCursor{
+		Date: time.Date(2024, 3, 31, 23, 59, 58, 123456000, time.UTC),
+		ID:   42,
+	}
+
+	got, err := decodeTransactionCursor(want.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != want.ID {
+		t.Errorf("ID = %d, want %d", got.ID, want.ID)
+	}
+	if !got.Date.Equal(want.Date) {
+		t.Errorf("Date = %v, want %v", got.Date, want.Date)
+	}
+	// The wall clock is what reaches a column without time zone
+	if got.Date.Location() != time.UTC || got.Date.Hour() != want.Date.Hour() {
+		t.Errorf("Date = %v, want wall clock of %v", got.Date, want.Date)
+	}
+}
+
+func TestDecodeTransactionCursorInvalid(t *testing.T) {
+	for _, s := range []string{"", "not base64!", "bm90IGEgY3Vyc29y"} {
+		if _, err := decodeTransactionCursor(s); err == nil {
+			t.Errorf("decodeTransactionCursor(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"crypto/rand"
+	"net/http"
+	"task-golang-db/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newReferralCode returns a random 8 character code without look-alike characters
+func newReferralCode() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = referralCodeAlphabet[int(b[i])%len(referralCodeAlphabet)]
+	}
+	return string(b), nil
+}
+
+var (
+	errInvalidReferralCode = newHTTPError(http.StatusBadRequest, "INVALID_REFERRAL_CODE", "Invalid referral code")
+	errInvalidCurrency     = newHTTPError(http.StatusBadRequest, "INVALID_CURRENCY", "Unsupported currency")
+)
+
+// createAccount creates a customer account with its own referral code,
+// linked to the account owning referralCode when one is given.
+// An empty currency means the default currency.
+func createAccount(db *gorm.DB, name, referralCode, currency string) (*model.Account, error) {
+	if currency == "" {
+		currency = model.DefaultCurrency
+	}
+	if !model.IsSupportedCurrency(currency) {
+		return nil, errInvalidCurrency
+	}
+
+	code, err := newReferralCode()
+	if err != nil {
+		return nil, err
+	}
+	account := model.Account{
+		Name:         name,
+		Currency:     currency,
+		ReferralCode: &code,
+	}
+
+	if referralCode != "" {
+		referrer := model.Account{}
+		if err := db.Where("referral_code = ?", referralCode).First(&referrer).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil, errInvalidReferralCode
+			}
+			return nil, err
+		}
+		account.ReferralAccountID = &referrer.AccountID
+	}
+
+	if err := db.Create(&account).Error; err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "CREATE_FAILED", err.Error())
+	}
+	return &account, nil
+}
+
+// setAccountOwner makes the login the owner of the account, owners can act as any of their accounts
+func setAccountOwner(db *gorm.DB, account *model.Account, authID int64) error {
+	if err := db.Model(account).Update("owner_auth_id", authID).Error; err != nil {
+		return err
+	}
+	account.OwnerAuthID = &authID
+	return nil
+}
+
+// payReferralBonus credits the bonus to the referee and the referrer when the
+// referee does their first topup. Both accounts must already be locked by the caller.
+// The bonus is set in the default currency and converted for other accounts.
+func payReferralBonus(tx *gorm.DB, referee, referrer *model.Account, bonus int64) error {
+	if referrer == nil || bonus <= 0 {
+		return nil
+	}
+
+	// Only the first topup counts, the current one is already recorded
+	var topups int64
+	if err := tx.Model(&model.Transaction{}).
+		Where("account_id = ? AND transaction_type = ?", referee.AccountID, model.TransactionTypeTopup).
+		Count(&topups).Error; err != nil {
+		return err
+	}
+	if topups != 1 {
+		return nil
+	}
+
+	// Each side gets the bonus in its own currency, funded by the
+	// referrals system account of that currency
+	postings := []model.Posting{}
+	var systemPostings []model.Posting
+	bonuses := map[int64]int64{}
+	for _, account := range []*model.Account{referee, referrer} {
+		rate, err := fxQuote(tx, model.DefaultCurrency, account.Currency)
+		if err != nil {
+			return err
+		}
+		amount, err := convertAmount(bonus, rate)
+		if err != nil {
+			return err
+		}
+		bonuses[account.AccountID] = amount
+
+		referralsID, err := systemAccountID(tx, systemAccountReferrals, account.Currency)
+		if err != nil {
+			return err
+		}
+		postings = append(postings, model.Posting{AccountID: account.AccountID, Amount: amount, Currency: account.Currency})
+		systemPostings = append(systemPostings, model.Posting{AccountID: referralsID, Amount: -amount, Currency: account.Currency})
+	}
+
+	entry, err := postJournalEntry(tx, model.EntryTypeReferralBonus, "Referral bonus", append(postings, systemPostings...))
+	if err != nil {
+		return err
+	}
+
+	// The referee row is locked so the topup count above can't race,
+	// the unique referee_account_id is only a safety net
+	reward := model.ReferralReward{
+		ReferrerAccountID: referrer.AccountID,
+		RefereeAccountID:  referee.AccountID,
+		Amount:            bonuses[referrer.AccountID],
+		JournalEntryID:    entry.JournalEntryID,
+	}
+	if err := tx.Create(&reward).Error; err != nil {
+		return err
+	}
+
+	now := time.Now()
+	transactions := []model.Transaction{}
+	for _, account := range []*model.Account{referee, referrer} {
+		transactions = append(transactions, model.Transaction{
+			AccountID:       account.AccountID,
+			Amount:          bonuses[account.AccountID],
+			TransactionDate: now,
+			TransactionType: model.TransactionTypeReferral,
+			JournalEntryID:  &entry.JournalEntryID,
+			Currency:        account.Currency,
+		})
+	}
+	if err := tx.Create(&transactions).Error; err != nil {
+		return err
+	}
+	return notifyTransactions(tx, transactions...)
+}
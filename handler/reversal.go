@@ -0,0 +1,293 @@
+package handler
+
+import (
+	"net/http"
+	"task-golang-db/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	errNotReversible        = newHTTPError(http.StatusBadRequest, "NOT_REVERSIBLE", "Only topups and transfers can be reversed")
+	errRefundExceedsOrigin  = newHTTPError(http.StatusBadRequest, "REFUND_EXCEEDS_ORIGINAL", "Refund is more than what is left of the original amount")
+	errReversalInsufficient = newHTTPError(http.StatusConflict, "INSUFFICIENT_BALANCE", "The account that received the money has insufficient balance")
+)
+
+// reversedOf selects the reversals posted by the ledger, whatever else claims a reversal_of_id
+func reversedOf(db *gorm.DB) *gorm.DB {
+	return db.Model(&model.Transaction{}).
+		Where("transaction_type = ? AND journal_entry_id IS NOT NULL", model.TransactionTypeReversal)
+}
+
+// reversedSoFar sums, as a positive amount, what was already given back on a transaction
+func reversedSoFar(tx *gorm.DB, transactionID int64) (int64, error) {
+	var sum int64
+	err := reversedOf(tx).
+		Where("reversal_of_id = ?", transactionID).
+		Select("COALESCE(SUM(ABS(amount)), 0)").
+		Scan(&sum).Error
+	return sum, err
+}
+
+// reverseTransaction gives back amount, or all that is left when amount is zero, of a
+// topup or transfer. The compensating transactions reference the legs they reverse.
+// It must be called inside a DB transaction.
+func reverseTransaction(tx *gorm.DB, transactionID, amount int64) ([]model.Transaction, error) {
+	var original model.Transaction
+	if err := tx.First(&original, transactionID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, newHTTPError(http.StatusNotFound, "TRANSACTION_NOT_FOUND", "Not found")
+		}
+		return nil, err
+	}
+	if original.JournalEntryID == nil {
+		return nil, errNotReversible
+	}
+
+	switch original.TransactionType {
+	case model.TransactionTypeTopup:
+		return reverseTopup(tx, &original, amount)
+	case model.TransactionTypeTransferOut, model.TransactionTypeTransferIn,
+		model.TransactionTypeInternalOut, model.TransactionTypeInternalIn:
+		return reverseTransfer(tx, &original, amount)
+	}
+	return nil, errNotReversible
+}
+
+// refundAmount checks the requested refund against what is left of the original
+func refundAmount(tx *gorm.DB, original *model.Transaction, requested int64) (int64, bool, error) {
+	if requested < 0 {
+		return 0, false, errRefundExceedsOrigin
+	}
+
+	reversed, err := reversedSoFar(tx, original.TransactionID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	left := abs(original.Amount) - reversed
+	if requested == 0 {
+		requested = left
+	}
+	if requested == 0 || requested > left {
+		return 0, false, errRefundExceedsOrigin
+	}
+	return requested, requested == left, nil
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func reverseTopup(tx *gorm.DB, topup *model.Transaction, amount int64) ([]model.Transaction, error) {
+	accounts, err := lockAccounts(tx, topup.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	account, ok := accounts[topup.AccountID]
+	if !ok {
+		return nil, errSenderNotFound
+	}
+
+	// Checked after the lock so concurrent refunds can't both pass
+	amount, _, err = refundAmount(tx, topup, amount)
+	if err != nil {
+		return nil, err
+	}
+	if account.Available() < amount {
+		return nil, errReversalInsufficient
+	}
+
+	cashInID, err := systemAccountID(tx, systemAccountCashIn, account.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := postJournalEntry(tx, model.EntryTypeReversal, "Topup reversal", []model.Posting{
+		{AccountID: account.AccountID, Amount: -amount, Currency: account.Currency},
+		{AccountID: cashInID, Amount: amount, Currency: account.Currency},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reversal := []model.Transaction{{
+		AccountID:       account.AccountID,
+		Amount:          -amount,
+		TransactionDate: time.Now(),
+		TransactionType: model.TransactionTypeReversal,
+		JournalEntryID:  &entry.JournalEntryID,
+		Currency:        account.Currency,
+		ReversalOfID:    &topup.TransactionID,
+	}}
+	if err := tx.Create(&reversal).Error; err != nil {
+		return nil, err
+	}
+	if err := notifyTransactions(tx, reversal...); err != nil {
+		return nil, err
+	}
+	return reversal, nil
+}
+
+// reverseTransfer moves money back from the receiver to the sender, at the rate of the
+// original transfer. The fee is not refunded. amount is in the sender's currency.
+func reverseTransfer(tx *gorm.DB, leg *model.Transaction, amount int64) ([]model.Transaction, error) {
+	// Find both legs of the original transfer
+	var legs []model.Transaction
+	if err := tx.Where("journal_entry_id = ? AND transaction_type IN ?", *leg.JournalEntryID, []string{
+		model.TransactionTypeTransferOut, model.TransactionTypeTransferIn,
+		model.TransactionTypeInternalOut, model.TransactionTypeInternalIn,
+	}).Find(&legs).Error; err != nil {
+		return nil, err
+	}
+
+	var out, in *model.Transaction
+	for i := range legs {
+		if legs[i].Amount < 0 {
+			out = &legs[i]
+		} else {
+			in = &legs[i]
+		}
+	}
+	if out == nil || in == nil {
+		return nil, errNotReversible
+	}
+
+	accounts, err := lockAccounts(tx, out.AccountID, in.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	sender, okSender := accounts[out.AccountID]
+	receiver, okReceiver := accounts[in.AccountID]
+	if !okSender || !okReceiver {
+		return nil, errTargetNotFound
+	}
+
+	// Checked after the lock so concurrent refunds can't both pass
+	refund, last, err := refundAmount(tx, out, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	// The receiver gives back the converted amount, the last refund takes
+	// whatever is left so rounding never leaves money behind
+	taken := refund
+	if out.FxRate != nil {
+		if last {
+			alreadyTaken, err := reversedSoFar(tx, in.TransactionID)
+			if err != nil {
+				return nil, err
+			}
+			taken = in.Amount - alreadyTaken
+		} else {
+			rate, err := parseRate(*out.FxRate)
+			if err != nil {
+				return nil, err
+			}
+			if taken, err = convertAmount(refund, rate); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if receiver.Available() < taken {
+		return nil, errReversalInsufficient
+	}
+
+	postings := []model.Posting{
+		{AccountID: receiver.AccountID, Amount: -taken, Currency: receiver.Currency},
+		{AccountID: sender.AccountID, Amount: refund, Currency: sender.Currency},
+	}
+	if sender.Currency != receiver.Currency {
+		fxSenderID, err := systemAccountID(tx, systemAccountFx, sender.Currency)
+		if err != nil {
+			return nil, err
+		}
+		fxReceiverID, err := systemAccountID(tx, systemAccountFx, receiver.Currency)
+		if err != nil {
+			return nil, err
+		}
+		postings = append(postings,
+			model.Posting{AccountID: fxReceiverID, Amount: taken, Currency: receiver.Currency},
+			model.Posting{AccountID: fxSenderID, Amount: -refund, Currency: sender.Currency},
+		)
+	}
+
+	entry, err := postJournalEntry(tx, model.EntryTypeReversal, "Transfer reversal", postings)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	reversal := []model.Transaction{
+		// Back to the sender, linked to the outgoing leg
+		{
+			AccountID:       sender.AccountID,
+			FromAccountID:   &receiver.AccountID,
+			ToAccountID:     &sender.AccountID,
+			Amount:          refund,
+			TransactionDate: now,
+			TransactionType: model.TransactionTypeReversal,
+			JournalEntryID:  &entry.JournalEntryID,
+			Currency:        sender.Currency,
+			FxRate:          out.FxRate,
+			ReversalOfID:    &out.TransactionID,
+		},
+		// Taken from the receiver, linked to the incoming leg
+		{
+			AccountID:       receiver.AccountID,
+			FromAccountID:   &receiver.AccountID,
+			ToAccountID:     &sender.AccountID,
+			Amount:          -taken,
+			TransactionDate: now,
+			TransactionType: model.TransactionTypeReversal,
+			JournalEntryID:  &entry.JournalEntryID,
+			Currency:        receiver.Currency,
+			FxRate:          in.FxRate,
+			ReversalOfID:    &in.TransactionID,
+		},
+	}
+	if err := tx.Create(&reversal).Error; err != nil {
+		return nil, err
+	}
+	if err := notifyTransactions(tx, reversal...); err != nil {
+		return nil, err
+	}
+	return reversal, nil
+}
+
+// fillReversedAmounts sets ReversedAmount on the transactions that were (partly) reversed
+func fillReversedAmounts(db *gorm.DB, transactions []model.Transaction) error {
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(transactions))
+	for i, t := range transactions {
+		ids[i] = t.TransactionID
+	}
+
+	var sums []struct {
+		ReversalOfID int64
+		Reversed     int64
+	}
+	if err := reversedOf(db).
+		Select("reversal_of_id, SUM(ABS(amount)) AS reversed").
+		Where("reversal_of_id IN ?", ids).
+		Group("reversal_of_id").
+		Scan(&sums).Error; err != nil {
+		return err
+	}
+
+	reversed := make(map[int64]int64, len(sums))
+	for _, s := range sums {
+		reversed[s.ReversalOfID] = s.Reversed
+	}
+	for i := range transactions {
+		transactions[i].ReversedAmount = reversed[transactions[i].TransactionID]
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Retry policy of failed standing order runs, the delay doubles on every retry
+const (
+	standingOrderMaxRetries = 3
+	standingOrderRetryDelay = 15 * time.Minute
+	standingOrderBatchSize  = 50
+)
+
+type StandingOrderInterface interface {
+	Create(*gin.Context)
+	Read(*gin.Context)
+	List(*gin.Context)
+	Cancel(*gin.Context)
+}
+
+type standingOrderImplement struct {
+	db *gorm.DB
+}
+
+func NewStandingOrder(db *gorm.DB) StandingOrderInterface {
+	return &standingOrderImplement{
+		db: db,
+	}
+}
+
+type standingOrderPayload struct {
+	TargetAccountID int64      `json:"target_account_id"`
+	Amount          int64      `json:"amount"`
+	Schedule        string     `json:"schedule"`
+	DayOfMonth      *int       `json:"day_of_month"`
+	StartAt         *time.Time `json:"start_at"`
+}
+
+func (s *standingOrderImplement) Create(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+	payload := standingOrderPayload{}
+
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if payload.Amount <= 0 || payload.TargetAccountID == accountID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid transfer request"})
+		return
+	}
+
+	now := time.Now()
+	startAt := now
+	if payload.StartAt != nil {
+		startAt = *payload.StartAt
+	}
+
+	switch payload.Schedule {
+	case model.ScheduleOnce:
+		if payload.StartAt == nil || !startAt.After(now) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "start_at must be in the future"})
+			return
+		}
+	case model.ScheduleDaily, model.ScheduleWeekly:
+	case model.ScheduleMonthly:
+		// Limited to 28 so every month has the day
+		if payload.DayOfMonth == nil || *payload.DayOfMonth < 1 || *payload.DayOfMonth > 28 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "day_of_month must be between 1 and 28"})
+			return
+		}
+		startAt = firstDayOfMonthAfter(startAt, *payload.DayOfMonth)
+	default:
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule, expected once, daily, weekly or monthly"})
+		return
+	}
+
+	// Check target account
+	var target model.Account
+	if err := s.db.First(&target, payload.TargetAccountID).Error; err != nil || target.SystemCode != nil {
+		abortWithError(c, errTargetNotFound)
+		return
+	}
+
+	order := model.StandingOrder{
+		AccountID:       accountID,
+		TargetAccountID: payload.TargetAccountID,
+		Amount:          payload.Amount,
+		Schedule:        payload.Schedule,
+		NextRunAt:       startAt,
+		Status:          model.StandingOrderActive,
+	}
+	if payload.Schedule == model.ScheduleMonthly {
+		order.DayOfMonth = payload.DayOfMonth
+	}
+	if err := s.db.Create(&order).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Create success",
+		"data":    order,
+	})
+}
+
+func (s *standingOrderImplement) Read(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	// Only the owner can see the order
+	var order model.StandingOrder
+	if err := s.db.Where("standing_order_id = ? AND account_id = ?", c.Param("id"), accountID).
+		First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	runs := []model.StandingOrderRun{}
+	if err := s.db.Where("standing_order_id = ?", order.StandingOrderID).
+		Order("standing_order_run_id DESC").
+		Find(&runs).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": order,
+		"runs": runs,
+	})
+}
+
+func (s *standingOrderImplement) List(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	orders := []model.StandingOrder{}
+	if err := s.db.Where("account_id = ?", accountID).
+		Order("standing_order_id DESC").
+		Find(&orders).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": orders})
+}
+
+func (s *standingOrderImplement) Cancel(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	result := s.db.Model(&model.StandingOrder{}).
+		Where("standing_order_id = ? AND account_id = ? AND status = ?", c.Param("id"), accountID, model.StandingOrderActive).
+		Update("status", model.StandingOrderCancelled)
+	if result.Error != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cancel success"})
+}
+
+// firstDayOfMonthAfter returns the first date on the given day of month not before t, at t's time of day
+func firstDayOfMonthAfter(t time.Time, day int) time.Time {
+	next := time.Date(t.Year(), t.Month(), day, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	if next.Before(t) {
+		next = next.AddDate(0, 1, 0)
+	}
+	return next
+}
+
+// nextOccurrence returns the run following scheduledAt, or false for a one-off order.
+// It is based on the scheduled time, not the execution time, so runs don't drift.
+func nextOccurrence(order *model.StandingOrder, scheduledAt time.Time) (time.Time, bool) {
+	switch order.Schedule {
+	case model.ScheduleDaily:
+		return scheduledAt.AddDate(0, 0, 1), true
+	case model.ScheduleWeekly:
+		return scheduledAt.AddDate(0, 0, 7), true
+	case model.ScheduleMonthly:
+		return firstDayOfMonthAfter(scheduledAt.AddDate(0, 0, 1), *order.DayOfMonth), true
+	}
+	return time.Time{}, false
+}
+
+// StandingOrderScheduler executes due standing orders in the background
+// through the same screening and transfer logic as the Transfer endpoint.
+type StandingOrderScheduler struct {
+	db       *gorm.DB
+	config   AccountConfig
+	fraud    *FraudScreener
+	interval time.Duration
+}
+
+func NewStandingOrderScheduler(db *gorm.DB, config AccountConfig, fraud *FraudScreener, interval time.Duration) *StandingOrderScheduler {
+	return &StandingOrderScheduler{
+		db:       db,
+		config:   config,
+		fraud:    fraud,
+		interval: interval,
+	}
+}
+
+// Run checks for due orders every interval until ctx is cancelled.
+// A run in progress is finished before Run returns.
+func (s *StandingOrderScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.runDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *StandingOrderScheduler) runDue(ctx context.Context) {
+	for i := 0; i < standingOrderBatchSize; i++ {
+		if ctx.Err() != nil {
+			return
+		}
+
+		ran, err := s.runNext()
+		if err != nil {
+			log.Println("Standing order scheduler:", err)
+			return
+		}
+		if !ran {
+			return
+		}
+	}
+}
+
+// runNext executes the oldest due order, it reports false when nothing is due.
+// SKIP LOCKED lets several server instances share the work.
+func (s *StandingOrderScheduler) runNext() (bool, error) {
+	ran := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var order model.StandingOrder
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND COALESCE(retry_at, next_run_at) <= ?", model.StandingOrderActive, time.Now()).
+			Order("COALESCE(retry_at, next_run_at)").
+			Take(&order).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ran = true
+
+		// Every run is screened, there is no login behind it so the review has no auth_id.
+		// A held run is executed as a plain transfer when its review is approved.
+		action, _, err := recordScreening(tx, s.fraud, &fraudSignal{
+			Operation:       model.FraudOperationTransfer,
+			AccountID:       order.AccountID,
+			Amount:          order.Amount,
+			TargetAccountID: &order.TargetAccountID,
+		}, gin.H{
+			"standing_order_id": order.StandingOrderID,
+			"target_account_id": order.TargetAccountID,
+			"amount":            order.Amount,
+		})
+		if err != nil {
+			return err
+		}
+
+		run := model.StandingOrderRun{
+			StandingOrderID: order.StandingOrderID,
+			ScheduledAt:     order.NextRunAt,
+			Attempt:         order.RetryCount + 1,
+			Status:          "success",
+		}
+
+		// The savepoint keeps the order lock when the transfer fails
+		var transactions []model.Transaction
+		var transferErr error
+		switch action {
+		case fraudActionBlock:
+			transferErr = errFraudBlocked
+		case fraudActionReview:
+			run.Status = "review"
+		default:
+			transferErr = tx.Transaction(func(tx *gorm.DB) error {
+				var err error
+				transactions, err = executeTransfer(tx, transferRequest{
+					FromAccountID: order.AccountID,
+					ToAccountID:   order.TargetAccountID,
+					Amount:        order.Amount,
+					Fee:           s.config.TransferFee,
+				})
+				return err
+			})
+		}
+
+		if transferErr == nil {
+			if transactions != nil {
+				run.JournalEntryID = transactions[0].JournalEntryID
+			}
+			order.RetryCount = 0
+			order.RetryAt = nil
+			order.LastError = nil
+			s.advance(&order)
+		} else {
+			message := transferErr.Error()
+			run.Status = "failed"
+			run.Error = &message
+			order.LastError = &message
+
+			if order.RetryCount < standingOrderMaxRetries {
+				// Retry the same occurrence later
+				order.RetryCount++
+				retryAt := time.Now().Add(standingOrderRetryDelay << (order.RetryCount - 1))
+				order.RetryAt = &retryAt
+			} else {
+				// Out of retries, give up on this occurrence
+				order.RetryCount = 0
+				order.RetryAt = nil
+				if !s.advance(&order) {
+					order.Status = model.StandingOrderFailed
+				}
+			}
+		}
+
+		if err := tx.Create(&run).Error; err != nil {
+			return err
+		}
+		return tx.Save(&order).Error
+	})
+
+	return ran, err
+}
+
+// advance moves the order to its next occurrence, or completes a one-off order.
+// It reports whether there is a next occurrence.
+func (s *StandingOrderScheduler) advance(order *model.StandingOrder) bool {
+	next, ok := nextOccurrence(order, order.NextRunAt)
+	if !ok {
+		order.Status = model.StandingOrderCompleted
+		return false
+	}
+
+	// Skip occurrences missed while the server was down
+	for !next.After(time.Now()) {
+		next, _ = nextOccurrence(order, next)
+	}
+	order.NextRunAt = next
+	return true
+}
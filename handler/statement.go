@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"task-golang-db/model"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type statementLine struct {
+	model.Transaction
+	RunningBalance int64 `json:"running_balance"`
+}
+
+type statement struct {
+	AccountID      int64           `json:"account_id"`
+	Month          string          `json:"month"`
+	Currency       string          `json:"currency"`
+	OpeningBalance int64           `json:"opening_balance"`
+	TotalIn        int64           `json:"total_in"`
+	TotalOut       int64           `json:"total_out"`
+	ClosingBalance int64           `json:"closing_balance"`
+	Transactions   []statementLine `json:"transactions"`
+}
+
+// ledgerTransactions limits a query to the transactions that moved money,
+// manual records are not part of the balance.
+func ledgerTransactions(db *gorm.DB, accountID int64) *gorm.DB {
+	return db.Model(&model.Transaction{}).
+		Where("account_id = ? AND journal_entry_id IS NOT NULL", accountID)
+}
+
+// buildStatement lists the money movements of the account in [start, end) with the running balance
+func buildStatement(db *gorm.DB, account *model.Account, start, end time.Time) (*statement, error) {
+	accountID := account.AccountID
+	s := statement{
+		AccountID:    accountID,
+		Month:        start.Format("2006-01"),
+		Currency:     account.Currency,
+		Transactions: []statementLine{},
+	}
+
+	// Opening balance is everything that happened before the period
+	if err := ledgerTransactions(db, accountID).
+		Where("transaction_date < ?", start).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&s.OpeningBalance).Error; err != nil {
+		return nil, err
+	}
+
+	var transactions []model.Transaction
+	if err := ledgerTransactions(db, accountID).
+		Where("transaction_date >= ? AND transaction_date < ?", start, end).
+		Order("transaction_date, transaction_id").
+		Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+
+	balance := s.OpeningBalance
+	for _, t := range transactions {
+		balance += t.Amount
+		if t.Amount > 0 {
+			s.TotalIn += t.Amount
+		} else {
+			s.TotalOut -= t.Amount
+		}
+		s.Transactions = append(s.Transactions, statementLine{Transaction: t, RunningBalance: balance})
+	}
+	s.ClosingBalance = balance
+
+	return &s, nil
+}
+
+// writeCSV writes the statement lines followed by the summary
+func (s *statement) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	format := func(v int64) string { return strconv.FormatInt(v, 10) }
+
+	cw.Write([]string{"account_id", format(s.AccountID)})
+	cw.Write([]string{"month", s.Month})
+	cw.Write([]string{"currency", s.Currency})
+	cw.Write([]string{"opening_balance", format(s.OpeningBalance)})
+	cw.Write([]string{})
+	cw.Write([]string{"transaction_id", "transaction_date", "transaction_type", "amount", "running_balance"})
+	for _, line := range s.Transactions {
+		cw.Write([]string{
+			format(line.TransactionID),
+			line.TransactionDate.Format(time.RFC3339),
+			line.TransactionType,
+			format(line.Amount),
+			format(line.RunningBalance),
+		})
+	}
+	cw.Write([]string{})
+	cw.Write([]string{"total_in", format(s.TotalIn)})
+	cw.Write([]string{"total_out", format(s.TotalOut)})
+	cw.Write([]string{"closing_balance", format(s.ClosingBalance)})
+
+	cw.Flush()
+	return cw.Error()
+}
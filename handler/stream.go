@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	streamHeartbeat      = 25 * time.Second
+	streamBuffer         = 16
+	listenReconnectDelay = 5 * time.Second
+)
+
+// AccountEventHub receives account events from Postgres LISTEN and fans them
+// out to the streams of each account. Every server instance runs its own hub,
+// so a change made through any instance reaches streams on all of them.
+type AccountEventHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[chan model.AccountEvent]struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewAccountEventHub() *AccountEventHub {
+	return &AccountEventHub{
+		subscribers: make(map[int64]map[chan model.AccountEvent]struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Listen keeps a dedicated connection listening on the events channel until ctx
+// is cancelled, it reconnects when the connection is lost.
+func (h *AccountEventHub) Listen(ctx context.Context, dsn string) {
+	for {
+		if err := h.listen(ctx, dsn); err != nil && ctx.Err() == nil {
+			log.Println("Account event listener:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenReconnectDelay):
+		}
+	}
+}
+
+func (h *AccountEventHub) listen(ctx context.Context, dsn string) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+model.AccountEventsChannel); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var event model.AccountEvent
+		if err := json.Unmarshal([]byte(notification.Payload), &event); err != nil {
+			log.Println("Account event listener: invalid payload:", err)
+			continue
+		}
+		h.publish(event)
+	}
+}
+
+// publish never blocks, a stream too slow to keep up misses events
+func (h *AccountEventHub) publish(event model.AccountEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[event.AccountID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func (h *AccountEventHub) subscribe(accountID int64) (chan model.AccountEvent, func()) {
+	ch := make(chan model.AccountEvent, streamBuffer)
+
+	h.mu.Lock()
+	if h.subscribers[accountID] == nil {
+		h.subscribers[accountID] = make(map[chan model.AccountEvent]struct{})
+	}
+	h.subscribers[accountID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers[accountID], ch)
+		if len(h.subscribers[accountID]) == 0 {
+			delete(h.subscribers, accountID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Close ends every open stream, so the server can shut down
+func (h *AccountEventHub) Close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+// notifyTransactions announces new transactions to the live streams of their
+// accounts. It must use the DB transaction that created them.
+func notifyTransactions(tx *gorm.DB, transactions ...model.Transaction) error {
+	for i := range transactions {
+		if err := model.NotifyAccountEvent(tx, transactions[i].AccountID, model.AccountEventTransaction, transactions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type StreamInterface interface {
+	Stream(*gin.Context)
+}
+
+type streamImplement struct {
+	db  *gorm.DB
+	hub *AccountEventHub
+}
+
+func NewStream(db *gorm.DB, hub *AccountEventHub) StreamInterface {
+	return &streamImplement{
+		db:  db,
+		hub: hub,
+	}
+}
+
+// balanceEvent reads the committed balance, shaped like the Balance response
+func (s *streamImplement) balanceEvent(accountID int64) (gin.H, error) {
+	var account model.Account
+	if err := s.db.Select("balance", "held_balance", "currency").
+		First(&account, accountID).Error; err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"balance":   account.Balance,
+		"held":      account.HeldBalance,
+		"available": account.Available(),
+		"currency":  account.Currency,
+	}, nil
+}
+
+// streamEndReason tells why the login may no longer stream, empty while it may.
+// The auth middleware only checks once, a stream outlives many of its checks.
+func (s *streamImplement) streamEndReason(c *gin.Context) (string, error) {
+	var revoked int64
+	if err := s.db.Model(&model.RevokedToken{}).Where("jti = ?", c.GetString("jti")).Count(&revoked).Error; err != nil {
+		return "", err
+	}
+	if revoked > 0 {
+		return "token_revoked", nil
+	}
+
+	// Logout and account suspension revoke every refresh token of the session
+	if sessionID := c.GetString("session_id"); sessionID != "" {
+		var active int64
+		if err := s.db.Model(&model.RefreshToken{}).
+			Where("family_id = ? AND revoked_at IS NULL", sessionID).
+			Count(&active).Error; err != nil {
+			return "", err
+		}
+		if active == 0 {
+			return "session_revoked", nil
+		}
+	}
+
+	var account model.Account
+	err := s.db.Select("account_id", "status").First(&account, c.GetInt64("account_id")).Error
+	if err == gorm.ErrRecordNotFound {
+		return "account_closed", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if account.Status == model.AccountSuspended {
+		return "account_suspended", nil
+	}
+	return "", nil
+}
+
+// Stream sends Server-Sent Events for the acting account: the balance when it
+// connects and after every change, and every new transaction. The stream ends
+// with a close event when the access token expires, and when the token, the
+// session or the account is revoked, which is checked at every heartbeat.
+func (s *streamImplement) Stream(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	// Subscribe before reading the balance, so no change in between is missed
+	events, unsubscribe := s.hub.subscribe(accountID)
+	defer unsubscribe()
+
+	balance, err := s.balanceEvent(accountID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve balance"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent(model.AccountEventBalance, balance)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	var expired <-chan time.Time
+	if expiresAt := c.GetTime("token_expires_at"); !expiresAt.IsZero() {
+		expiry := time.NewTimer(time.Until(expiresAt))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+	end := func(reason string) {
+		c.SSEvent("close", gin.H{"reason": reason})
+		c.Writer.Flush()
+	}
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-s.hub.closed:
+			return
+		case <-expired:
+			end("token_expired")
+			return
+		case <-heartbeat.C:
+			reason, err := s.streamEndReason(c)
+			if err != nil {
+				log.Println("Account stream:", err)
+			} else if reason != "" {
+				end(reason)
+				return
+			}
+
+			// A comment line keeps proxies from closing an idle stream
+			if _, err := c.Writer.WriteString(": ping\n\n"); err != nil {
+				return
+			}
+		case event := <-events:
+			switch event.Event {
+			case model.AccountEventBalance:
+				balance, err := s.balanceEvent(accountID)
+				if err != nil {
+					log.Println("Account stream:", err)
+					continue
+				}
+				c.SSEvent(model.AccountEventBalance, balance)
+			case model.AccountEventTransaction:
+				c.SSEvent(model.AccountEventTransaction, event.Data)
+			}
+		}
+		c.Writer.Flush()
+	}
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"net/http"
+	"strconv"
 	"task-golang-db/model"
 	"time"
 
@@ -12,22 +13,46 @@ import (
 type TransactionInterface interface {
 	NewTransaction(*gin.Context)
 	TransactionList(*gin.Context)
+	Export(*gin.Context)
+	Import(*gin.Context)
+	Reverse(*gin.Context)
 }
 
 type transactionImplement struct {
-	db *gorm.DB
+	db    *gorm.DB
+	fraud *FraudScreener
 }
 
 // NewTransaction adalah handler untuk transaksi baru
-func NewTransaction(db *gorm.DB) TransactionInterface {
+func NewTransaction(db *gorm.DB, fraud *FraudScreener) TransactionInterface {
 	return &transactionImplement{
-		db: db,
+		db:    db,
+		fraud: fraud,
+	}
+}
+
+// manualTransactionPayload adalah isian transaksi manual, field lain seperti
+// reversal_of_id atau fx_rate hanya diisi oleh ledger
+type manualTransactionPayload struct {
+	TransactionCategoryID *int64    `json:"transaction_category_id"`
+	Amount                int64     `json:"amount"`
+	TransactionDate       time.Time `json:"transaction_date"`
+}
+
+// transaction membuat record transaksi manual untuk akun
+func (p manualTransactionPayload) transaction(accountID int64) model.Transaction {
+	return model.Transaction{
+		TransactionCategoryID: p.TransactionCategoryID,
+		AccountID:             accountID,
+		Amount:                p.Amount,
+		TransactionDate:       p.TransactionDate,
+		TransactionType:       model.TransactionTypeManual,
 	}
 }
 
 // NewTransaction membuat record transaksi baru
 func (t *transactionImplement) NewTransaction(c *gin.Context) {
-	var payload model.Transaction
+	var payload manualTransactionPayload
 
 	// Bind JSON request ke payload
 	if err := c.ShouldBindJSON(&payload); err != nil {
@@ -42,15 +67,54 @@ func (t *transactionImplement) NewTransaction(c *gin.Context) {
 		return
 	}
 
-	payload.AccountID = accountID.(int64)
-
-	// Set tanggal transaksi ke waktu saat ini jika tidak disediakan
+	// Set tanggal transaksi ke waktu saat ini jika tidak disediakan,
+	// juga untuk transaksi yang ditahan fraud dan dibuat nanti
 	if payload.TransactionDate.IsZero() {
 		payload.TransactionDate = time.Now()
 	}
 
-	// Buat record transaksi
-	if err := t.db.Create(&payload).Error; err != nil {
+	// Manual records never move money, they are not part of the ledger
+	transaction := payload.transaction(accountID.(int64))
+
+	// Akun yang dibekukan atau ditangguhkan tidak bisa membuat transaksi
+	var account model.Account
+	if err := t.db.Select("account_id", "status").First(&account, transaction.AccountID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve account: " + err.Error()})
+		return
+	}
+	if err := checkActive(&account); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Kategori harus milik sendiri atau kategori global
+	if transaction.TransactionCategoryID != nil {
+		if _, err := findUsableCategory(t.db, transaction.AccountID, *transaction.TransactionCategoryID); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+
+	// Cek aturan fraud, transaksi yang ditahan dibuat setelah disetujui admin
+	amount := transaction.Amount
+	if amount < 0 {
+		amount = -amount
+	}
+	if !screenOperation(c, t.db, t.fraud, fraudSignal{
+		Operation: model.FraudOperationTransaction,
+		AccountID: transaction.AccountID,
+		Amount:    amount,
+	}, payload) {
+		return
+	}
+
+	// Buat record transaksi, diumumkan ke stream akun saat commit
+	if err := t.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&transaction).Error; err != nil {
+			return err
+		}
+		return notifyTransactions(tx, transaction)
+	}); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create transaction: " + err.Error()})
 		return
 	}
@@ -58,14 +122,12 @@ func (t *transactionImplement) NewTransaction(c *gin.Context) {
 	// Respon sukses
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Transaction created successfully",
-		"data":    payload,
+		"data":    transaction,
 	})
 }
 
-// TransactionList mengembalikan daftar transaksi berdasarkan `account_id`
+// TransactionList mengembalikan daftar transaksi berdasarkan `account_id`, per halaman dengan cursor
 func (t *transactionImplement) TransactionList(c *gin.Context) {
-	var transactions []model.Transaction
-
 	// Ambil `account_id` dari context
 	accountID, exists := c.Get("account_id")
 	if !exists {
@@ -73,17 +135,160 @@ func (t *transactionImplement) TransactionList(c *gin.Context) {
 		return
 	}
 
-	// Siapkan query untuk mengambil 10 transaksi terakhir berdasarkan account_id
-	if err := t.db.Where("account_id = ?", accountID).
-		Order("transaction_date DESC").
-		Limit(10).
-		Find(&transactions).Error; err != nil {
+	// Baca filter dan cursor dari query string
+	filter, err := parseTransactionFilter(c)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	transactions, nextCursor, err := findTransactionPage(t.db, accountID.(int64), filter)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transactions: " + err.Error()})
 		return
 	}
 
 	// Respon sukses dengan data transaksi
 	c.JSON(http.StatusOK, gin.H{
-		"data": transactions,
+		"data":        transactions,
+		"next_cursor": nextCursor,
+	})
+}
+
+// Export mengirim riwayat transaksi dalam format csv, ofx atau qif, baris demi baris
+func (t *transactionImplement) Export(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	// Filter tanggal dan lainnya sama dengan TransactionList
+	filter, err := parseTransactionFilter(c)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	var account model.Account
+	if err := t.db.First(&account, accountID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve account: " + err.Error()})
+		return
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	exporter := newTransactionExporter(format, &account, filter)
+	if exporter == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, expected csv, ofx or qif"})
+		return
+	}
+
+	rows, err := filter.apply(t.db.Model(&model.Transaction{}).Where("account_id = ?", accountID)).
+		Order("transaction_date, transaction_id").
+		Rows()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transactions: " + err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", exporter.contentType())
+	c.Header("Content-Disposition", "attachment; filename=transactions."+format)
+	c.Status(http.StatusOK)
+
+	// Header sudah terkirim, error setelah ini hanya bisa menghentikan stream
+	if err := exporter.begin(c.Writer); err != nil {
+		return
+	}
+	for rows.Next() {
+		var transaction model.Transaction
+		if err := t.db.ScanRows(rows, &transaction); err != nil {
+			return
+		}
+		if err := exporter.write(c.Writer, &transaction); err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+	if rows.Err() != nil {
+		return
+	}
+	exporter.end(c.Writer)
+}
+
+// Import membuat banyak transaksi manual sekaligus dari file CSV
+func (t *transactionImplement) Import(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	// Sama seperti transaksi manual, akun yang tidak aktif tidak bisa mengimpor
+	var account model.Account
+	if err := t.db.Select("account_id", "status").First(&account, accountID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve account: " + err.Error()})
+		return
+	}
+	if err := checkActive(&account); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file is required: " + err.Error()})
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	// dry_run hanya memvalidasi, create_categories membuat kategori yang belum ada
+	dryRun := c.Query("dry_run") == "true"
+	createCategories := c.Query("create_categories") == "true"
+
+	report, err := importTransactions(t.db, accountID, f, dryRun, createCategories)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CSV: " + err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	if report.Failed > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	c.JSON(status, gin.H{"data": report})
+}
+
+// Reverse mengembalikan sebagian atau seluruh topup atau transfer, khusus admin
+func (t *transactionImplement) Reverse(c *gin.Context) {
+	var payload struct {
+		Amount int64 `json:"amount"` // kosong berarti seluruh sisa nominal
+	}
+
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	// get id from url transaction/reverse/5, 5 will be the original transaction id
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transaction id"})
+		return
+	}
+
+	var reversal []model.Transaction
+	err = t.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		reversal, err = reverseTransaction(tx, id, payload.Amount)
+		return err
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Respon sukses
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Reversal successful",
+		"data":    reversal,
 	})
 }
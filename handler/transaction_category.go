@@ -1,11 +1,14 @@
 package handler
 
 import (
-	"task-golang-db/model"
+	"encoding/json"
 	"net/http"
+	"task-golang-db/model"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type TransactionCategoryInterface interface {
@@ -16,8 +19,16 @@ type TransactionCategoryInterface interface {
 	List(*gin.Context)
 
 	My(*gin.Context)
+	SetBudget(*gin.Context)
+	Budget(*gin.Context)
 }
 
+// Budget status thresholds, in percent of the monthly budget
+const (
+	budgetWarningPercent  = 80
+	budgetExceededPercent = 100
+)
+
 type transactionCatImplement struct {
 	db *gorm.DB
 }
@@ -28,8 +39,51 @@ func NewTransactionCategory(db *gorm.DB) TransactionCategoryInterface {
 	}
 }
 
+var (
+	errCategoryNotFound   = newHTTPError(http.StatusNotFound, "CATEGORY_NOT_FOUND", "Not found")
+	errCategoryNotAllowed = newHTTPError(http.StatusForbidden, "CATEGORY_NOT_ALLOWED", "Only the owner can change this category")
+)
+
+// usableCategories limits a query to the caller's own categories and the global defaults
+func usableCategories(db *gorm.DB, accountID int64) *gorm.DB {
+	return db.Where("account_id IS NULL OR account_id = ?", accountID)
+}
+
+// findUsableCategory returns the category when the account can use it
+func findUsableCategory(db *gorm.DB, accountID int64, id interface{}) (*model.TransactionCategory, error) {
+	transactcat := model.TransactionCategory{}
+	if err := usableCategories(db, accountID).
+		Where("transaction_category_id = ?", id).
+		First(&transactcat).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errCategoryNotFound
+		}
+		return nil, err
+	}
+	return &transactcat, nil
+}
+
+// findOwnedCategory returns the category when the caller may change it,
+// own categories by their owner and global ones by admins
+func findOwnedCategory(c *gin.Context, db *gorm.DB, id interface{}) (*model.TransactionCategory, error) {
+	transactcat, err := findUsableCategory(db, c.GetInt64("account_id"), id)
+	if err != nil {
+		return nil, err
+	}
+
+	if transactcat.AccountID == nil && c.GetString("role") != model.RoleAdmin {
+		return nil, errCategoryNotAllowed
+	}
+	return transactcat, nil
+}
+
+type transactionCategoryPayload struct {
+	Name   string `json:"name"`
+	Global bool   `json:"global"` // admins only, creates a shared default category
+}
+
 func (a *transactionCatImplement) Create(c *gin.Context) {
-	payload := model.TransactionCategory{}
+	payload := transactionCategoryPayload{}
 
 	// bind JSON Request to payload
 	err := c.BindJSON(&payload)
@@ -40,40 +94,45 @@ func (a *transactionCatImplement) Create(c *gin.Context) {
 		return
 	}
 
+	// Categories belong to the caller unless an admin creates a global one
+	transactcat := model.TransactionCategory{Name: payload.Name}
+	if payload.Global {
+		if c.GetString("role") != model.RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Only admins can create global categories",
+			})
+			return
+		}
+	} else {
+		accountID := c.GetInt64("account_id")
+		transactcat.AccountID = &accountID
+	}
+
 	// Create data
-	result := a.db.Create(&payload)
+	result := a.db.Create(&transactcat)
 	if result.Error != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": result.Error.Error(),
 		})
 		return
 	}
+	auditChange(c, "category.create", "transaction_category", transactcat.ID, nil, snapshot(transactcat))
 
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Create success",
-		"data":    payload,
+		"data":    transactcat,
 	})
 }
 
 func (a *transactionCatImplement) Read(c *gin.Context) {
-	var transcat model.TransactionCategory
-
-	// get id from url account/read/5, 5 will be the id
+	// get id from url transaction-category/read/5, 5 will be the id
 	id := c.Param("id")
 
-	// Find first data based on id and put to account model
-	if err := a.db.First(&transcat, id).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-				"error": "Not found",
-			})
-			return
-		}
-
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
-		})
+	// Find the category among mine and the global ones
+	transcat, err := findUsableCategory(a.db, c.GetInt64("account_id"), id)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
 
@@ -84,65 +143,65 @@ func (a *transactionCatImplement) Read(c *gin.Context) {
 }
 
 func (a *transactionCatImplement) Update(c *gin.Context) {
-    payload := model.TransactionCategory{}
-
-    // bind JSON Request to payload
-    err := c.BindJSON(&payload)
-    if err != nil {
-        c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-            "error": err.Error(),
-        })
-        return
-    }
-
-    // get id from url account/update/5, 5 will be the id
-    id := c.Param("id")
-
-    // Find first data based on id and put to account model
-    transactcat := model.TransactionCategory{}
-    result := a.db.First(&transactcat, "transaction_category_id = ?", id)
-    if result.Error != nil {
-        if result.Error == gorm.ErrRecordNotFound {
-            c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-                "error": "Not found",
-            })
-            return
-        }
-        c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-            "error": result.Error.Error(),
-        })
-        return
-    }
-
-    // Update data
-    transactcat.Name = payload.Name
-    updateResult := a.db.Save(&transactcat) // Save the updated transaction category
-    if updateResult.Error != nil {
-        c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-            "error": updateResult.Error.Error(),
-        })
-        return
-    }
-
-    // Success response
-    c.JSON(http.StatusOK, gin.H{
-        "message": "Update success",
-        "data":    transactcat, // Return the updated data
-    })
-}
+	payload := transactionCategoryPayload{}
+
+	// bind JSON Request to payload
+	err := c.BindJSON(&payload)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// get id from url transaction-category/update/5, 5 will be the id
+	id := c.Param("id")
+
+	// Find the category, only the owner may change it
+	transactcat, err := findOwnedCategory(c, a.db, id)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// Update data
+	before := snapshot(transactcat)
+	transactcat.Name = payload.Name
+	updateResult := a.db.Save(transactcat) // Save the updated transaction category
+	if updateResult.Error != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"error": updateResult.Error.Error(),
+		})
+		return
+	}
+	auditChange(c, "category.update", "transaction_category", transactcat.ID, before, snapshot(transactcat))
 
+	// Success response
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Update success",
+		"data":    transactcat, // Return the updated data
+	})
+}
 
 func (a *transactionCatImplement) Delete(c *gin.Context) {
-	// get id from url account/delete/5, 5 will be the id
+	// get id from url transaction-category/delete/5, 5 will be the id
 	id := c.Param("id")
 
+	// Find the category, only the owner may delete it
+	transactcat, err := findOwnedCategory(c, a.db, id)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
 	// Delete the data based on id
-	if err := a.db.Where("transaction_category_id = ?", id).Delete(&model.TransactionCategory{}).Error; err != nil {
+	if err := a.db.Delete(transactcat).Error; err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
 		return
 	}
+	auditChange(c, "category.delete", "transaction_category", transactcat.ID, snapshot(transactcat), nil)
 
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
@@ -155,10 +214,12 @@ func (a *transactionCatImplement) Delete(c *gin.Context) {
 
 func (a *transactionCatImplement) List(c *gin.Context) {
 	// Prepare empty result
-	var transactcats []model.TransactionCategory
+	transactcats := []model.TransactionCategory{}
 
-	// Find and get all accounts data and put to &accounts
-	if err := a.db.Find(&transactcats).Error; err != nil {
+	// Find my categories and the global ones
+	if err := usableCategories(a.db, c.GetInt64("account_id")).
+		Order("transaction_category_id").
+		Find(&transactcats).Error; err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
@@ -172,19 +233,14 @@ func (a *transactionCatImplement) List(c *gin.Context) {
 }
 
 func (a *transactionCatImplement) My(c *gin.Context) {
-	var transactcat model.TransactionCategory
-	transactcatID := c.GetInt64("transaction_category_id")
-
-	// Find first data based on transaction_category_id given
-	if err := a.db.First(&transactcat, transactcatID).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
-				"error": "Not found",
-			})
-			return
-		}
+	// Prepare empty result
+	transactcats := []model.TransactionCategory{}
 
-		c.JSON(http.StatusBadRequest, gin.H{
+	// Find only the categories owned by the account_id from middleware auth
+	if err := a.db.Where("account_id = ?", c.GetInt64("account_id")).
+		Order("transaction_category_id").
+		Find(&transactcats).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
 		})
 		return
@@ -192,6 +248,122 @@ func (a *transactionCatImplement) My(c *gin.Context) {
 
 	// Success response
 	c.JSON(http.StatusOK, gin.H{
-		"data": transactcat,
+		"data": transactcats,
+	})
+}
+
+func (a *transactionCatImplement) SetBudget(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+	var payload struct {
+		Amount int64 `json:"amount"`
+	}
+
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if payload.Amount < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid budget amount"})
+		return
+	}
+
+	// get id from url transaction-category/budget/5, 5 will be the category id
+	transactcat, err := findUsableCategory(a.db, accountID, c.Param("id"))
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// The previous budget, if any, for the audit log
+	var before json.RawMessage
+	previous := model.CategoryBudget{}
+	if err := a.db.Where("account_id = ? AND transaction_category_id = ?", accountID, transactcat.ID).
+		Take(&previous).Error; err == nil {
+		before = snapshot(previous)
+	}
+
+	// A zero amount removes the budget
+	if payload.Amount == 0 {
+		if err := a.db.Where("account_id = ? AND transaction_category_id = ?", accountID, transactcat.ID).
+			Delete(&model.CategoryBudget{}).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		auditChange(c, "category.budget_remove", "transaction_category", transactcat.ID, before, nil)
+		c.JSON(http.StatusOK, gin.H{"message": "Budget removed"})
+		return
+	}
+
+	budget := model.CategoryBudget{
+		AccountID:             accountID,
+		TransactionCategoryID: transactcat.ID,
+		Amount:                payload.Amount,
+	}
+	if err := a.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "account_id"}, {Name: "transaction_category_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"amount"}),
+	}).Create(&budget).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	auditChange(c, "category.budget_set", "transaction_category", transactcat.ID, before, snapshot(budget))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Budget saved",
+		"data":    budget,
+	})
+}
+
+type budgetStatus struct {
+	TransactionCategoryID int64  `json:"transaction_category_id"`
+	Name                  string `json:"name"`
+	Budget                int64  `json:"budget"`
+	Spent                 int64  `json:"spent"`
+	Remaining             int64  `json:"remaining"`
+	Percent               int64  `json:"percent"`
+	Status                string `json:"status"`
+}
+
+func (a *transactionCatImplement) Budget(c *gin.Context) {
+	accountID := c.GetInt64("account_id")
+
+	// Spending is counted for the current calendar month
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	end := start.AddDate(0, 1, 0)
+
+	budgets := []budgetStatus{}
+	if err := a.db.Table("category_budgets b").
+		Select("b.transaction_category_id, c.name, b.amount AS budget, COALESCE(SUM(-t.amount), 0) AS spent").
+		Joins("JOIN transaction_categories c ON c.transaction_category_id = b.transaction_category_id").
+		Joins(`LEFT JOIN "transaction" t ON t.transaction_category_id = b.transaction_category_id
+			AND t.account_id = b.account_id AND t.amount < 0
+			AND t.transaction_date >= ? AND t.transaction_date < ?`, start, end).
+		Where("b.account_id = ?", accountID).
+		Group("b.transaction_category_id, c.name, b.amount").
+		Order("b.transaction_category_id").
+		Scan(&budgets).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Flag categories that crossed 80% and 100% of their budget
+	for i := range budgets {
+		b := &budgets[i]
+		b.Remaining = b.Budget - b.Spent
+		b.Percent = b.Spent * 100 / b.Budget
+		switch {
+		case b.Percent >= budgetExceededPercent:
+			b.Status = "exceeded"
+		case b.Percent >= budgetWarningPercent:
+			b.Status = "warning"
+		default:
+			b.Status = "ok"
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"month": start.Format("2006-01"),
+		"data":  budgets,
 	})
-}
\ No newline at end of file
+}
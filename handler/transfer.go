@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"task-golang-db/model"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	errSenderNotFound      = newHTTPError(http.StatusNotFound, "SENDER_NOT_FOUND", "Sender account not found")
+	errTargetNotFound      = newHTTPError(http.StatusNotFound, "TARGET_NOT_FOUND", "Target account not found")
+	errInsufficientBalance = newHTTPError(http.StatusBadRequest, "INSUFFICIENT_BALANCE", "Insufficient balance")
+)
+
+type transferRequest struct {
+	FromAccountID int64
+	ToAccountID   int64
+	Amount        int64
+	Fee           int64
+	Internal      bool // between wallets of the same login
+	Settling      bool // hold capture or closure sweep, allowed from a closing account
+	Payout        bool // closure sweep, recorded as a closure payout
+	Captured      bool // hold capture, the limits were checked when the hold was authorized
+}
+
+// lockAccounts selects the accounts FOR UPDATE in ascending account_id order,
+// so two transfers between the same pair of accounts can never deadlock.
+// Missing accounts are absent from the returned map.
+func lockAccounts(tx *gorm.DB, accountIDs ...int64) (map[int64]*model.Account, error) {
+	ids := append([]int64(nil), accountIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	locked := make(map[int64]*model.Account, len(ids))
+	for _, id := range ids {
+		if _, ok := locked[id]; ok {
+			continue
+		}
+
+		var account model.Account
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("account_id = ?", id).
+			Take(&account).Error
+		if err == gorm.ErrRecordNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		locked[id] = &account
+	}
+
+	return locked, nil
+}
+
+// executeTransfer moves money from one account to another and records the
+// transactions of both sides. It must be called inside a DB transaction,
+// the balance check and the postings happen while both accounts are locked.
+func executeTransfer(tx *gorm.DB, req transferRequest) ([]model.Transaction, error) {
+	accounts, err := lockAccounts(tx, req.FromAccountID, req.ToAccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, ok := accounts[req.FromAccountID]
+	if !ok || sender.SystemCode != nil {
+		return nil, errSenderNotFound
+	}
+	target, ok := accounts[req.ToAccountID]
+	if !ok || target.SystemCode != nil {
+		return nil, errTargetNotFound
+	}
+	if err := checkCanSend(sender, req.Settling); err != nil {
+		return nil, err
+	}
+	if err := checkCanReceive(target); err != nil {
+		return nil, err
+	}
+
+	// The sender also pays the transfer fee, in the sender's currency.
+	// Held funds can't be spent.
+	if sender.Available() < req.Amount+req.Fee {
+		return nil, errInsufficientBalance
+	}
+
+	// Moving between own wallets is not limited, nor is the closure payout,
+	// which must be able to move a balance of any size in one go.
+	// A hold capture was limited when the hold was authorized.
+	if !req.Internal && !req.Payout && !req.Captured {
+		if err := checkLimit(tx, sender, model.LimitTransfer, req.Amount); err != nil {
+			return nil, err
+		}
+	}
+
+	// The target receives the amount converted to its own currency
+	rate, err := fxQuote(tx, sender.Currency, target.Currency)
+	if err != nil {
+		return nil, err
+	}
+	received, err := convertAmount(req.Amount, rate)
+	if err != nil {
+		return nil, err
+	}
+	if received <= 0 {
+		return nil, newHTTPError(http.StatusBadRequest, "AMOUNT_TOO_SMALL", "Amount is too small to convert")
+	}
+
+	feesID, err := systemAccountID(tx, systemAccountFees, sender.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	postings := []model.Posting{
+		{AccountID: sender.AccountID, Amount: -(req.Amount + req.Fee), Currency: sender.Currency},
+		{AccountID: target.AccountID, Amount: received, Currency: target.Currency},
+		{AccountID: feesID, Amount: req.Fee, Currency: sender.Currency},
+	}
+
+	// A cross-currency transfer goes through the fx system accounts,
+	// which buy the sender's currency and sell the target's
+	crossCurrency := sender.Currency != target.Currency
+	if crossCurrency {
+		fxSenderID, err := systemAccountID(tx, systemAccountFx, sender.Currency)
+		if err != nil {
+			return nil, err
+		}
+		fxTargetID, err := systemAccountID(tx, systemAccountFx, target.Currency)
+		if err != nil {
+			return nil, err
+		}
+		postings = append(postings,
+			model.Posting{AccountID: fxSenderID, Amount: req.Amount, Currency: sender.Currency},
+			model.Posting{AccountID: fxTargetID, Amount: -received, Currency: target.Currency},
+		)
+	}
+
+	description, outType, inType := "Transfer", model.TransactionTypeTransferOut, model.TransactionTypeTransferIn
+	switch {
+	case req.Payout:
+		description, outType, inType = "Closure payout", model.TransactionTypePayoutOut, model.TransactionTypePayoutIn
+	case req.Internal:
+		description, outType, inType = "Internal transfer", model.TransactionTypeInternalOut, model.TransactionTypeInternalIn
+	}
+
+	entry, err := postJournalEntry(tx, model.EntryTypeTransfer, description, postings)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	transactions := []model.Transaction{
+		// Catat transaksi pengirim, saldo berkurang
+		{
+			AccountID:       req.FromAccountID,
+			FromAccountID:   &req.FromAccountID,
+			ToAccountID:     &req.ToAccountID,
+			Amount:          -req.Amount,
+			TransactionDate: now,
+			TransactionType: outType,
+			JournalEntryID:  &entry.JournalEntryID,
+			Currency:        sender.Currency,
+		},
+		// Catat transaksi penerima, saldo bertambah
+		{
+			AccountID:       req.ToAccountID,
+			FromAccountID:   &req.FromAccountID,
+			ToAccountID:     &req.ToAccountID,
+			Amount:          received,
+			TransactionDate: now,
+			TransactionType: inType,
+			JournalEntryID:  &entry.JournalEntryID,
+			Currency:        target.Currency,
+		},
+	}
+	if crossCurrency {
+		// Each leg shows the rate and what the other side sent or received
+		sent := -req.Amount
+		appliedRate := formatRate(rate)
+		transactions[0].FxRate = &appliedRate
+		transactions[0].CounterAmount = &received
+		transactions[0].CounterCurrency = &target.Currency
+		transactions[1].FxRate = &appliedRate
+		transactions[1].CounterAmount = &sent
+		transactions[1].CounterCurrency = &sender.Currency
+	}
+	if req.Fee > 0 {
+		transactions = append(transactions, model.Transaction{
+			AccountID:       req.FromAccountID,
+			Amount:          -req.Fee,
+			TransactionDate: now,
+			TransactionType: model.TransactionTypeFee,
+			JournalEntryID:  &entry.JournalEntryID,
+			Currency:        sender.Currency,
+		})
+	}
+	if err := tx.Create(&transactions).Error; err != nil {
+		return nil, err
+	}
+	if err := notifyTransactions(tx, transactions...); err != nil {
+		return nil, err
+	}
+
+	// Announced to webhooks once the transaction commits
+	if err := enqueueWebhookEvent(tx, model.EventTransferSent, req.FromAccountID, transactions[0]); err != nil {
+		return nil, err
+	}
+	if err := enqueueWebhookEvent(tx, model.EventTransferReceived, req.ToAccountID, transactions[1]); err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"task-golang-db/model"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Transfers in both directions between the same pair of accounts must never
+// deadlock, overdraw or create money.
+func TestExecuteTransferConcurrent(t *testing.T) {
+	db := openTestDB(t)
+
+	const (
+		initial   = 1000
+		amount    = 70
+		transfers = 50 // per direction
+	)
+	a := newFundedAccount(t, db, model.CurrencyIDR, initial)
+	b := newFundedAccount(t, db, model.CurrencyIDR, initial)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*transfers)
+	for i := 0; i < transfers; i++ {
+		for _, pair := range [][2]int64{{a.AccountID, b.AccountID}, {b.AccountID, a.AccountID}} {
+			wg.Add(1)
+			go func(from, to int64) {
+				defer wg.Done()
+				err := db.Transaction(func(tx *gorm.DB) error {
+					_, err := executeTransfer(tx, transferRequest{
+						FromAccountID: from,
+						ToAccountID:   to,
+						Amount:        amount,
+					})
+					return err
+				})
+				// Running out of money is expected, anything else is not
+				if err != nil && !errors.Is(err, errInsufficientBalance) {
+					errs <- err
+				}
+			}(pair[0], pair[1])
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "40P01" {
+			t.Errorf("deadlock: %v", err)
+			continue
+		}
+		t.Errorf("transfer failed: %v", err)
+	}
+
+	balanceA, balanceB := balanceOf(t, db, a.AccountID), balanceOf(t, db, b.AccountID)
+	if balanceA < 0 || balanceB < 0 {
+		t.Errorf("negative balance: a=%d b=%d", balanceA, balanceB)
+	}
+	if balanceA+balanceB != 2*initial {
+		t.Errorf("total balance = %d, want %d", balanceA+balanceB, 2*initial)
+	}
+}
+
+func TestExecuteTransferMissingTarget(t *testing.T) {
+	db := openTestDB(t)
+	a := newFundedAccount(t, db, model.CurrencyIDR, 100)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := executeTransfer(tx, transferRequest{
+			FromAccountID: a.AccountID,
+			ToAccountID:   -1,
+			Amount:        10,
+		})
+		return err
+	})
+	if !errors.Is(err, errTargetNotFound) {
+		t.Fatalf("err = %v, want %v", err, errTargetNotFound)
+	}
+	if got := balanceOf(t, db, a.AccountID); got != 100 {
+		t.Errorf("balance = %d, want 100", got)
+	}
+}
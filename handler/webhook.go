@@ -0,0 +1,453 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	webhookBatchSize   = 50
+	webhookMaxAttempts = 8
+	webhookRetryDelay  = 30 * time.Second
+	webhookTimeout     = 10 * time.Second
+	webhookLease       = 6 * webhookTimeout // a claimed delivery is retried after this if the sender died
+)
+
+var errWebhookNotFound = newHTTPError(http.StatusNotFound, "WEBHOOK_NOT_FOUND", "Not found")
+
+type WebhookInterface interface {
+	Create(*gin.Context)
+	List(*gin.Context)
+	Delete(*gin.Context)
+	Deliveries(*gin.Context)
+}
+
+type webhookImplement struct {
+	db *gorm.DB
+}
+
+func NewWebhook(db *gorm.DB) WebhookInterface {
+	return &webhookImplement{
+		db: db,
+	}
+}
+
+type webhookCreatePayload struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"` // generated when empty
+	EventTypes []string `json:"event_types"`
+	AccountID  *int64   `json:"account_id"` // empty for the events of every account
+}
+
+// Create subscribes a URL to events. The secret is only shown in this response.
+func (w *webhookImplement) Create(c *gin.Context) {
+	payload := webhookCreatePayload{}
+
+	// bind JSON Request to payload
+	if err := c.BindJSON(&payload); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	target, err := url.Parse(payload.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid url"})
+		return
+	}
+
+	if len(payload.EventTypes) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "At least one event type is required"})
+		return
+	}
+	for _, eventType := range payload.EventTypes {
+		if !isWebhookEventType(eventType) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid event type " + eventType,
+				"valid": model.WebhookEventTypes,
+			})
+			return
+		}
+	}
+
+	if payload.Secret == "" {
+		if payload.Secret, err = randomToken(32); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	subscription := model.WebhookSubscription{
+		URL:        payload.URL,
+		Secret:     payload.Secret,
+		EventTypes: strings.Join(payload.EventTypes, ","),
+		AccountID:  payload.AccountID,
+		Active:     true,
+		CreatedBy:  c.GetInt64("auth_id"),
+	}
+	if err := w.db.Create(&subscription).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Webhook created",
+		"data":    subscription,
+		"secret":  subscription.Secret,
+	})
+}
+
+func isWebhookEventType(eventType string) bool {
+	for _, t := range model.WebhookEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webhookImplement) List(c *gin.Context) {
+	subscriptions := []model.WebhookSubscription{}
+	if err := w.db.Order("webhook_subscription_id").Find(&subscriptions).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": subscriptions})
+}
+
+// Delete deactivates the subscription, its delivery log is kept
+func (w *webhookImplement) Delete(c *gin.Context) {
+	result := w.db.Model(&model.WebhookSubscription{}).
+		Where("webhook_subscription_id = ?", c.Param("id")).
+		Update("active", false)
+	if result.Error != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		abortWithError(c, errWebhookNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+type webhookDeliveryLog struct {
+	model.WebhookDelivery
+	EventType string                 `json:"event_type"`
+	Log       []model.WebhookAttempt `json:"attempts_log" gorm:"-"`
+}
+
+// Deliveries lists the deliveries of a subscription, newest first, with every attempt
+func (w *webhookImplement) Deliveries(c *gin.Context) {
+	query := w.db.Table("webhook_deliveries d").
+		Select("d.*, e.event_type").
+		Joins("JOIN webhook_events e ON e.webhook_event_id = d.webhook_event_id").
+		Where("d.webhook_subscription_id = ?", c.Param("id")).
+		Order("d.webhook_delivery_id DESC").
+		Limit(100)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("d.status = ?", status)
+	}
+
+	deliveries := []webhookDeliveryLog{}
+	if err := query.Scan(&deliveries).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ids := make([]int64, len(deliveries))
+	for i := range deliveries {
+		ids[i] = deliveries[i].WebhookDeliveryID
+	}
+	var attempts []model.WebhookAttempt
+	if err := w.db.Where("webhook_delivery_id IN ?", ids).Order("webhook_attempt_id").Find(&attempts).Error; err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	byDelivery := make(map[int64][]model.WebhookAttempt)
+	for _, attempt := range attempts {
+		byDelivery[attempt.WebhookDeliveryID] = append(byDelivery[attempt.WebhookDeliveryID], attempt)
+	}
+	for i := range deliveries {
+		deliveries[i].Log = byDelivery[deliveries[i].WebhookDeliveryID]
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": deliveries})
+}
+
+// enqueueWebhookEvent writes an event to the outbox. It must use the DB transaction
+// of the change, so the event exists exactly when the change was committed.
+func enqueueWebhookEvent(tx *gorm.DB, eventType string, accountID int64, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&model.WebhookEvent{
+		EventType: eventType,
+		AccountID: accountID,
+		Payload:   payload,
+	}).Error
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.body" with the subscription secret
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher turns outbox events into deliveries and sends them in the background
+type WebhookDispatcher struct {
+	db       *gorm.DB
+	client   *http.Client
+	interval time.Duration
+}
+
+func NewWebhookDispatcher(db *gorm.DB, interval time.Duration) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:       db,
+		client:   &http.Client{Timeout: webhookTimeout},
+		interval: interval,
+	}
+}
+
+// Run dispatches events and sends due deliveries every interval until ctx is cancelled
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		d.runBatch(ctx, d.dispatchNext)
+		d.runBatch(ctx, d.deliverNext)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *WebhookDispatcher) runBatch(ctx context.Context, next func(context.Context) (bool, error)) {
+	for i := 0; i < webhookBatchSize; i++ {
+		if ctx.Err() != nil {
+			return
+		}
+
+		done, err := next(ctx)
+		if err != nil {
+			log.Println("Webhook dispatcher:", err)
+			return
+		}
+		if !done {
+			return
+		}
+	}
+}
+
+// dispatchNext creates the deliveries of the oldest undispatched event,
+// it reports false when there is none. An event another dispatcher is fanning
+// out is skipped rather than waited on, and gets its deliveries only once.
+func (d *WebhookDispatcher) dispatchNext(context.Context) (bool, error) {
+	found := false
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		var event model.WebhookEvent
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("dispatched_at IS NULL").
+			Order("webhook_event_id").
+			Take(&event).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+
+		var subscriptions []model.WebhookSubscription
+		err = tx.Where("active AND ? = ANY(string_to_array(event_types, ',')) AND (account_id IS NULL OR account_id = ?)",
+			event.EventType, event.AccountID).
+			Find(&subscriptions).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, subscription := range subscriptions {
+			delivery := model.WebhookDelivery{
+				WebhookEventID:        event.WebhookEventID,
+				WebhookSubscriptionID: subscription.WebhookSubscriptionID,
+				Status:                model.WebhookDeliveryPending,
+				NextAttemptAt:         now,
+			}
+			if err := tx.Create(&delivery).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&event).Update("dispatched_at", now).Error
+	})
+
+	return found, err
+}
+
+// deliverNext sends the oldest due delivery and schedules a retry when it fails.
+// The delivery is claimed in a short transaction and sent after it committed,
+// so no row lock or connection is held while waiting on the subscriber.
+func (d *WebhookDispatcher) deliverNext(ctx context.Context) (bool, error) {
+	delivery, event, subscription, err := d.claimNext()
+	if err != nil || delivery == nil {
+		return false, err
+	}
+	if subscription == nil {
+		// Nothing to send, the delivery was closed
+		return true, nil
+	}
+
+	attempt := d.send(ctx, delivery, event, subscription)
+
+	// Stopping the server is not the subscriber's fault, the delivery is
+	// due again right away and the attempt is not counted
+	if ctx.Err() == context.Canceled {
+		return false, d.db.Model(delivery).Update("next_attempt_at", time.Now()).Error
+	}
+
+	err = d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+		recordWebhookAttempt(delivery, &attempt, time.Now())
+		return tx.Save(delivery).Error
+	})
+	return true, err
+}
+
+// claimNext takes the oldest due delivery and moves its next attempt past the
+// lease, other dispatchers skip it until then. The subscription is nil when the
+// delivery was closed because the subscription was deleted.
+func (d *WebhookDispatcher) claimNext() (*model.WebhookDelivery, *model.WebhookEvent, *model.WebhookSubscription, error) {
+	var delivery *model.WebhookDelivery
+	var event model.WebhookEvent
+	var subscription model.WebhookSubscription
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		var due model.WebhookDelivery
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", model.WebhookDeliveryPending, time.Now()).
+			Order("next_attempt_at").
+			Take(&due).Error
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		delivery = &due
+
+		if err := tx.First(&event, due.WebhookEventID).Error; err != nil {
+			return err
+		}
+		if err := tx.First(&subscription, due.WebhookSubscriptionID).Error; err != nil {
+			return err
+		}
+
+		// Deleted subscriptions get nothing more
+		if !subscription.Active {
+			due.Status = model.WebhookDeliveryFailed
+			return tx.Save(&due).Error
+		}
+
+		due.NextAttemptAt = time.Now().Add(webhookLease)
+		return tx.Model(&due).Update("next_attempt_at", due.NextAttemptAt).Error
+	})
+	if err != nil || delivery == nil {
+		return nil, nil, nil, err
+	}
+	if delivery.Status != model.WebhookDeliveryPending {
+		return delivery, nil, nil, nil
+	}
+	return delivery, &event, &subscription, nil
+}
+
+// recordWebhookAttempt updates the delivery after an attempt. Failed attempts are
+// retried with an exponential backoff until webhookMaxAttempts.
+func recordWebhookAttempt(delivery *model.WebhookDelivery, attempt *model.WebhookAttempt, now time.Time) {
+	delivery.Attempts++
+	if attempt.Error == nil {
+		delivery.Status = model.WebhookDeliveryDelivered
+		delivery.DeliveredAt = &attempt.AttemptedAt
+	} else if delivery.Attempts >= webhookMaxAttempts {
+		delivery.Status = model.WebhookDeliveryFailed
+	} else {
+		delivery.NextAttemptAt = now.Add(webhookRetryDelay << (delivery.Attempts - 1))
+	}
+}
+
+// send posts the signed event, any status other than 2xx is a failed attempt
+func (d *WebhookDispatcher) send(ctx context.Context, delivery *model.WebhookDelivery, event *model.WebhookEvent, subscription *model.WebhookSubscription) model.WebhookAttempt {
+	attempt := model.WebhookAttempt{
+		WebhookDeliveryID: delivery.WebhookDeliveryID,
+		AttemptedAt:       time.Now(),
+	}
+	fail := func(err error) model.WebhookAttempt {
+		message := err.Error()
+		attempt.Error = &message
+		attempt.DurationMs = time.Since(attempt.AttemptedAt).Milliseconds()
+		return attempt
+	}
+
+	body, err := json.Marshal(gin.H{
+		"id":         event.WebhookEventID,
+		"type":       event.EventType,
+		"account_id": event.AccountID,
+		"created_at": event.CreatedAt,
+		"data":       json.RawMessage(event.Payload),
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return fail(err)
+	}
+	timestamp := strconv.FormatInt(attempt.AttemptedAt.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.WebhookDeliveryID, 10))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(subscription.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	attempt.StatusCode = &resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fail(fmt.Errorf("unexpected status %d", resp.StatusCode))
+	}
+	attempt.DurationMs = time.Since(attempt.AttemptedAt).Milliseconds()
+	return attempt
+}
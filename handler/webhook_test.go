@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"task-golang-db/model"
+)
+
+// webhookReceiver answers with the given status codes in turn, the last one repeats
+func webhookReceiver(t *testing.T, secret string, statuses ...int) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&calls, 1))
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		timestamp := r.Header.Get("X-Webhook-Timestamp")
+		if want := "sha256=" + signWebhook(secret, timestamp, body); r.Header.Get("X-Webhook-Signature") != want {
+			t.Errorf("signature = %q, want %q", r.Header.Get("X-Webhook-Signature"), want)
+		}
+		if r.Header.Get("X-Webhook-Event") != model.EventTopupCompleted {
+			t.Errorf("event header = %q", r.Header.Get("X-Webhook-Event"))
+		}
+
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestWebhookSendSigned(t *testing.T) {
+	server, calls := webhookReceiver(t, "s3cret", http.StatusOK)
+	d := NewWebhookDispatcher(nil, time.Second)
+
+	delivery := model.WebhookDelivery{WebhookDeliveryID: 7}
+	event := model.WebhookEvent{WebhookEventID: 3, EventType: model.EventTopupCompleted, Payload: []byte(`{"amount":100}`)}
+	subscription := model.WebhookSubscription{URL: server.URL, Secret: "s3cret"}
+
+	attempt := d.send(context.Background(), &delivery, &event, &subscription)
+	if attempt.Error != nil {
+		t.Fatalf("attempt failed: %s", *attempt.Error)
+	}
+	if attempt.StatusCode == nil || *attempt.StatusCode != http.StatusOK {
+		t.Errorf("status code = %v, want 200", attempt.StatusCode)
+	}
+	if *calls != 1 {
+		t.Errorf("receiver called %d times, want 1", *calls)
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	server, _ := webhookReceiver(t, "s3cret", http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK)
+	d := NewWebhookDispatcher(nil, time.Second)
+
+	delivery := model.WebhookDelivery{WebhookDeliveryID: 7, Status: model.WebhookDeliveryPending}
+	event := model.WebhookEvent{EventType: model.EventTopupCompleted, Payload: []byte(`{}`)}
+	subscription := model.WebhookSubscription{URL: server.URL, Secret: "s3cret"}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Two failures wait 30s then 60s, the third attempt is delivered
+	for _, wantDelay := range []time.Duration{webhookRetryDelay, 2 * webhookRetryDelay} {
+		attempt := d.send(context.Background(), &delivery, &event, &subscription)
+		if attempt.Error == nil {
+			t.Fatal("attempt succeeded, want a failure")
+		}
+		recordWebhookAttempt(&delivery, &attempt, now)
+		if delivery.Status != model.WebhookDeliveryPending || !delivery.NextAttemptAt.Equal(now.Add(wantDelay)) {
+			t.Errorf("after %d attempts: status %s, next attempt in %s, want pending in %s",
+				delivery.Attempts, delivery.Status, delivery.NextAttemptAt.Sub(now), wantDelay)
+		}
+	}
+
+	attempt := d.send(context.Background(), &delivery, &event, &subscription)
+	recordWebhookAttempt(&delivery, &attempt, now)
+	if delivery.Status != model.WebhookDeliveryDelivered || delivery.Attempts != 3 {
+		t.Errorf("status %s after %d attempts, want delivered after 3", delivery.Status, delivery.Attempts)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	delivery := model.WebhookDelivery{Status: model.WebhookDeliveryPending, Attempts: webhookMaxAttempts - 1}
+	message := "unexpected status 500"
+	recordWebhookAttempt(&delivery, &model.WebhookAttempt{Error: &message}, time.Now())
+	if delivery.Status != model.WebhookDeliveryFailed {
+		t.Errorf("status = %s, want failed", delivery.Status)
+	}
+}
+
+// deliverNext sends outside its claim and records the result, a cancelled
+// dispatcher doesn't count an attempt
+func TestDeliverNext(t *testing.T) {
+	db := openTestDB(t)
+	server, calls := webhookReceiver(t, "s3cret", http.StatusInternalServerError, http.StatusOK)
+	d := NewWebhookDispatcher(db, time.Second)
+
+	subscription := model.WebhookSubscription{URL: server.URL, Secret: "s3cret", EventTypes: model.EventTopupCompleted, Active: true}
+	if err := db.Create(&subscription).Error; err != nil {
+		t.Fatal(err)
+	}
+	event := model.WebhookEvent{EventType: model.EventTopupCompleted, Payload: []byte(`{}`)}
+	if err := db.Create(&event).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Due long ago so it is the first one picked
+	due := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	delivery := model.WebhookDelivery{
+		WebhookEventID:        event.WebhookEventID,
+		WebhookSubscriptionID: subscription.WebhookSubscriptionID,
+		Status:                model.WebhookDeliveryPending,
+		NextAttemptAt:         due,
+	}
+	if err := db.Create(&delivery).Error; err != nil {
+		t.Fatal(err)
+	}
+	reload := func() model.WebhookDelivery {
+		t.Helper()
+		var current model.WebhookDelivery
+		if err := db.First(&current, delivery.WebhookDeliveryID).Error; err != nil {
+			t.Fatal(err)
+		}
+		return current
+	}
+	makeDue := func() {
+		t.Helper()
+		if err := db.Model(&delivery).Update("next_attempt_at", due).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.deliverNext(cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if current := reload(); current.Attempts != 0 || current.NextAttemptAt.After(time.Now()) {
+		t.Errorf("cancelled send counted: %d attempts, next at %s", current.Attempts, current.NextAttemptAt)
+	}
+
+	makeDue()
+	if _, err := d.deliverNext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	current := reload()
+	if current.Status != model.WebhookDeliveryPending || current.Attempts != 1 ||
+		!current.NextAttemptAt.After(time.Now()) {
+		t.Errorf("after a failure: status %s, %d attempts, next at %s", current.Status, current.Attempts, current.NextAttemptAt)
+	}
+
+	makeDue()
+	if _, err := d.deliverNext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if current := reload(); current.Status != model.WebhookDeliveryDelivered || current.Attempts != 2 {
+		t.Errorf("status %s after %d attempts, want delivered after 2", current.Status, current.Attempts)
+	}
+	if *calls != 2 {
+		t.Errorf("receiver called %d times, want 2", *calls)
+	}
+
+	var attempts int64
+	if err := db.Model(&model.WebhookAttempt{}).Where("webhook_delivery_id = ?", delivery.WebhookDeliveryID).
+		Count(&attempts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("%d attempts logged, want 2", attempts)
+	}
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
-	"net/http"
 
 	"task-golang-db/handler"
 	"task-golang-db/middleware"
+	"task-golang-db/model"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -35,61 +38,228 @@ func main() {
 	// Get signing key from .env
 	signingKey := os.Getenv("SIGNING_KEY")
 
+	// Get transfer fee charged to the sender and the referral bonus, zero when not set
+	transferFee, _ := strconv.ParseInt(os.Getenv("TRANSFER_FEE"), 10, 64)
+	referralBonus, _ := strconv.ParseInt(os.Getenv("REFERRAL_BONUS"), 10, 64)
+
+	// Whether frozen accounts still accept topups, they do unless set to false
+	frozenAllowsTopup := os.Getenv("FROZEN_ALLOWS_TOPUP") != "false"
+
+	// Closed accounts can be reopened for 30 days unless set otherwise
+	reopenDays, err := strconv.Atoi(os.Getenv("ACCOUNT_REOPEN_DAYS"))
+	if err != nil {
+		reopenDays = 30
+	}
+
+	// Fraud rules are read from a JSON file, reloaded when it changes
+	fraudScreener, err := handler.NewFraudScreener(os.Getenv("FRAUD_RULES"))
+	if err != nil {
+		log.Fatal("Failed to load fraud rules:", err)
+	}
+
 	// Initialize Gin router
 	r := gin.Default()
 
+	// Every request gets an id, every mutating request an audit log row
+	r.Use(middleware.RequestID(), middleware.Audit(db))
+
 	// Initialize Handlers
 	authHandler := handler.NewAuth(db, []byte(signingKey))
-	accountHandler := handler.NewAccount(db)
+	accountConfig := handler.AccountConfig{
+		TransferFee:   transferFee,
+		ReferralBonus: referralBonus,
+
+		ReopenGracePeriod: time.Duration(reopenDays) * 24 * time.Hour,
+		FrozenAllowsTopup: frozenAllowsTopup,
+	}
+	accountHandler := handler.NewAccount(db, accountConfig, fraudScreener)
 	transCatHandler := handler.NewTransactionCategory(db)
-	transactionHandler := handler.NewTransaction(db)
+	transactionHandler := handler.NewTransaction(db, fraudScreener)
+	standingOrderHandler := handler.NewStandingOrder(db)
+	fxHandler := handler.NewFx(db)
+	holdHandler := handler.NewHold(db, accountConfig, fraudScreener)
+	limitHandler := handler.NewLimit(db)
+	fraudReviewHandler := handler.NewFraudReview(db, accountConfig)
+	webhookHandler := handler.NewWebhook(db)
+	auditHandler := handler.NewAudit(db)
+
+	// Live account events, received from Postgres so every instance sees every change
+	eventHub := handler.NewAccountEventHub()
+	streamHandler := handler.NewStream(db, eventHub)
+
+	// Validates the access token and rejects revoked ones
+	authMiddleware := middleware.AuthMiddleware(db, signingKey)
+
+	// Admins manage data, support staff can only read it
+	adminOnly := middleware.RequireRole(model.RoleAdmin)
+	staffOnly := middleware.RequireRole(model.RoleAdmin, model.RoleSupport)
+
+	// Retried money-moving requests replay their first response
+	idempotency := middleware.Idempotency(db)
 
 	// Define Routes
 	// Auth routes
 	authRoute := r.Group("/auth")
 	{
 		authRoute.POST("/login", authHandler.Login)
-		authRoute.POST("/upsert", authHandler.Upsert)
+		authRoute.POST("/register", authHandler.Register)
+		authRoute.POST("/password", authMiddleware, authHandler.ChangePassword)
+		authRoute.POST("/admin/credentials", authMiddleware, adminOnly, authHandler.AdminSetCredentials)
+		authRoute.POST("/refresh", authHandler.Refresh)
+		authRoute.POST("/logout", authMiddleware, authHandler.Logout)
+		authRoute.POST("/role", authMiddleware, adminOnly, authHandler.SetRole)
 	}
 
 	// Account routes
 	accountRoutes := r.Group("/account")
 	{
-		accountRoutes.POST("/create", accountHandler.Create)
-		accountRoutes.GET("/read/:id", accountHandler.Read)
-		accountRoutes.PATCH("/update/:id", accountHandler.Update)
-		accountRoutes.DELETE("/delete/:id", accountHandler.Delete)
-		accountRoutes.GET("/list", accountHandler.List)
-		accountRoutes.GET("/my", middleware.AuthMiddleware(signingKey), accountHandler.My)
-		accountRoutes.POST("/topup", middleware.AuthMiddleware(signingKey), accountHandler.Topup)
-		accountRoutes.GET("/balance", middleware.AuthMiddleware(signingKey), accountHandler.Balance)
-		accountRoutes.POST("/transfer", middleware.AuthMiddleware(signingKey), accountHandler.Transfer)
-		accountRoutes.GET("/mutation", middleware.AuthMiddleware(signingKey), accountHandler.Mutation)
+		accountRoutes.POST("/create", authMiddleware, adminOnly, accountHandler.Create)
+		accountRoutes.GET("/read/:id", authMiddleware, staffOnly, accountHandler.Read)
+		accountRoutes.PATCH("/update/:id", authMiddleware, adminOnly, accountHandler.Update)
+		accountRoutes.DELETE("/delete/:id", authMiddleware, adminOnly, accountHandler.Delete)
+		accountRoutes.POST("/reopen/:id", authMiddleware, adminOnly, accountHandler.Reopen)
+		accountRoutes.POST("/close", authMiddleware, accountHandler.Close)
+		accountRoutes.POST("/status/:id", authMiddleware, adminOnly, accountHandler.SetStatus)
+		accountRoutes.GET("/status-history/:id", authMiddleware, staffOnly, accountHandler.StatusHistory)
+		accountRoutes.GET("/list", authMiddleware, staffOnly, accountHandler.List)
+		accountRoutes.GET("/my", authMiddleware, accountHandler.My)
+		accountRoutes.POST("/topup", authMiddleware, idempotency, accountHandler.Topup)
+		accountRoutes.GET("/balance", authMiddleware, accountHandler.Balance)
+		accountRoutes.POST("/transfer", authMiddleware, idempotency, accountHandler.Transfer)
+		accountRoutes.GET("/mutation", authMiddleware, accountHandler.Mutation)
+		accountRoutes.GET("/statement", authMiddleware, accountHandler.Statement)
+		accountRoutes.GET("/referrals", authMiddleware, accountHandler.Referrals)
+		accountRoutes.POST("/wallet", authMiddleware, accountHandler.CreateWallet)
+		accountRoutes.POST("/move", authMiddleware, idempotency, accountHandler.MoveBetweenWallets)
+		accountRoutes.GET("/stream", authMiddleware, streamHandler.Stream)
 	}
 
 	// Transaction Category routes
 	transCatRoutes := r.Group("/transaction-category")
 	{
-		transCatRoutes.POST("/create", middleware.AuthMiddleware(signingKey), transCatHandler.Create)
-		transCatRoutes.GET("/read/:id", transCatHandler.Read)
-		transCatRoutes.PATCH("/update/:id", transCatHandler.Update)
-		transCatRoutes.DELETE("/delete/:id", transCatHandler.Delete)
-		transCatRoutes.GET("/list", transCatHandler.List)
+		transCatRoutes.POST("/create", authMiddleware, transCatHandler.Create)
+		transCatRoutes.GET("/read/:id", authMiddleware, transCatHandler.Read)
+		transCatRoutes.PATCH("/update/:id", authMiddleware, transCatHandler.Update)
+		transCatRoutes.DELETE("/delete/:id", authMiddleware, transCatHandler.Delete)
+		transCatRoutes.GET("/list", authMiddleware, transCatHandler.List)
+		transCatRoutes.GET("/my", authMiddleware, transCatHandler.My)
+		transCatRoutes.PUT("/budget/:id", authMiddleware, transCatHandler.SetBudget)
+		transCatRoutes.GET("/budget", authMiddleware, transCatHandler.Budget)
 	}
 
 	// Transaction routes
 	transactionRoutes := r.Group("/transaction")
 	{
-		transactionRoutes.POST("/create", middleware.AuthMiddleware(signingKey), transactionHandler.NewTransaction)
-		transactionRoutes.GET("/list", middleware.AuthMiddleware(signingKey), transactionHandler.TransactionList)
+		transactionRoutes.POST("/create", authMiddleware, idempotency, transactionHandler.NewTransaction)
+		transactionRoutes.GET("/list", authMiddleware, transactionHandler.TransactionList)
+		transactionRoutes.GET("/export", authMiddleware, transactionHandler.Export)
+		transactionRoutes.POST("/import", authMiddleware, transactionHandler.Import)
+		transactionRoutes.POST("/reverse/:id", authMiddleware, adminOnly, idempotency, transactionHandler.Reverse)
+	}
+
+	// Exchange rate routes
+	fxRoutes := r.Group("/fx", authMiddleware)
+	{
+		fxRoutes.PUT("/rate", adminOnly, fxHandler.SetRate)
+		fxRoutes.GET("/list", fxHandler.List)
+	}
+
+	// Standing order routes
+	standingOrderRoutes := r.Group("/standing-order", authMiddleware)
+	{
+		standingOrderRoutes.POST("/create", standingOrderHandler.Create)
+		standingOrderRoutes.GET("/read/:id", standingOrderHandler.Read)
+		standingOrderRoutes.GET("/list", standingOrderHandler.List)
+		standingOrderRoutes.POST("/cancel/:id", standingOrderHandler.Cancel)
+	}
+
+	// Limit routes
+	limitRoutes := r.Group("/limit", authMiddleware)
+	{
+		limitRoutes.PUT("/set", adminOnly, limitHandler.Set)
+		limitRoutes.GET("/list", staffOnly, limitHandler.List)
+		limitRoutes.GET("/my", limitHandler.My)
+	}
+
+	// Fraud review queue, operations held by the fraud rules
+	fraudRoutes := r.Group("/fraud/review", authMiddleware)
+	{
+		fraudRoutes.GET("/list", staffOnly, fraudReviewHandler.List)
+		fraudRoutes.POST("/approve/:id", adminOnly, fraudReviewHandler.Approve)
+		fraudRoutes.POST("/reject/:id", adminOnly, fraudReviewHandler.Reject)
+	}
+
+	// Webhook routes, for back-office systems
+	webhookRoutes := r.Group("/webhook", authMiddleware, adminOnly)
+	{
+		webhookRoutes.POST("/create", webhookHandler.Create)
+		webhookRoutes.GET("/list", webhookHandler.List)
+		webhookRoutes.DELETE("/delete/:id", webhookHandler.Delete)
+		webhookRoutes.GET("/deliveries/:id", webhookHandler.Deliveries)
+	}
+
+	// Audit routes
+	auditRoutes := r.Group("/audit", authMiddleware, adminOnly)
+	{
+		auditRoutes.GET("/list", auditHandler.List)
 	}
 
+	// Hold routes, two-phase transfers
+	holdRoutes := r.Group("/hold", authMiddleware)
+	{
+		holdRoutes.POST("/authorize", idempotency, holdHandler.Authorize)
+		holdRoutes.POST("/capture/:id", idempotency, holdHandler.Capture)
+		holdRoutes.POST("/void/:id", holdHandler.Void)
+		holdRoutes.GET("/list", holdHandler.List)
+	}
+
+	// Start background workers, they stop when ctx is cancelled on shutdown
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+
+	scheduler := handler.NewStandingOrderScheduler(db, accountConfig, fraudScreener, time.Minute)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		scheduler.Run(ctx)
+	}()
+
+	holdExpirer := handler.NewHoldExpirer(db, time.Minute)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		holdExpirer.Run(ctx)
+	}()
+
+	idempotencyCleaner := middleware.NewIdempotencyKeyCleaner(db, time.Hour)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		idempotencyCleaner.Run(ctx)
+	}()
+
+	webhookDispatcher := handler.NewWebhookDispatcher(db, 10*time.Second)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		webhookDispatcher.Run(ctx)
+	}()
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		eventHub.Listen(ctx, os.Getenv("DATABASE"))
+	}()
+
 	// Graceful shutdown setup
 	srv := &http.Server{
 		Addr:    ":8080",
 		Handler: r,
 	}
 
+	// Open event streams never finish by themselves, end them when shutdown starts
+	srv.RegisterOnShutdown(eventHub.Close)
+
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen: %s\n", err)
@@ -103,12 +273,16 @@ func main() {
 	log.Println("Shutting down server...")
 
 	// Graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
 
+	// Let workers finish their current run before the DB is closed
+	stopWorkers()
+	workers.Wait()
+
 	log.Println("Server exiting")
 }
 
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"task-golang-db/model"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Audit writes an audit log row for every request that may change data,
+// after it was handled. Handlers describe what they changed with the "audit"
+// context key. It must run after RequestID.
+func Audit(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		c.Next()
+
+		entry := model.AuditLog{
+			RequestID:  c.GetString("request_id"),
+			Role:       c.GetString("role"),
+			Action:     c.Request.Method + " " + c.FullPath(),
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.Path,
+			StatusCode: c.Writer.Status(),
+			IP:         c.ClientIP(),
+		}
+		if authID, ok := c.Get("auth_id"); ok {
+			id := authID.(int64)
+			entry.AuthID = &id
+		}
+		// A change set in a transaction that was rolled back did not happen
+		if change, ok := c.Get("audit"); ok && entry.StatusCode < http.StatusBadRequest {
+			change := change.(*model.AuditChange)
+			entry.Action = change.Action
+			entry.Entity = change.Entity
+			entry.EntityID = change.EntityID
+			entry.Before = change.Before
+			entry.After = change.After
+		}
+
+		// The response was already sent, a failed write can only be logged
+		if err := db.Create(&entry).Error; err != nil {
+			log.Println("Audit log:", err)
+		}
+	}
+}
@@ -2,12 +2,14 @@ package middleware
 
 import (
 	"net/http"
+	"task-golang-db/model"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
-func AuthMiddleware(secretKey string) gin.HandlerFunc {
+func AuthMiddleware(db *gorm.DB, secretKey string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString := c.GetHeader("Authorization")
 
@@ -25,22 +27,84 @@ func AuthMiddleware(secretKey string) gin.HandlerFunc {
 			return
 		}
 
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+
+		// Tokens without jti can't be revoked, they are not accepted
+		jti, _ := claims["jti"].(string)
+		if jti == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+
+		// Check the token was not revoked by logout
+		var revoked int64
+		if err := db.Model(&model.RevokedToken{}).Where("jti = ?", jti).Count(&revoked).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+		if revoked > 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token revoked"})
+			c.Abort()
+			return
+		}
+
 		// Set the token claims to the context
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			if authID, ok := claims["auth_id"].(float64); ok {
-				c.Set("auth_id", int64(authID))
-			}
-			if accountID, ok := claims["account_id"].(float64); ok {
-				c.Set("account_id", int64(accountID))
+		c.Set("jti", jti)
+		if authID, ok := claims["auth_id"].(float64); ok {
+			c.Set("auth_id", int64(authID))
+		}
+		if accountID, ok := claims["account_id"].(float64); ok {
+			c.Set("account_id", int64(accountID))
+		}
+
+		// Act as another wallet of the same login, chosen per request
+		if header := c.GetHeader("X-Account-ID"); header != "" {
+			var owned model.Account
+			if err := db.Where("account_id = ? AND owner_auth_id = ?", header, c.GetInt64("auth_id")).
+				First(&owned).Error; err != nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Account not owned by this login"})
+				c.Abort()
+				return
 			}
-			if username, ok := claims["username"].(string); ok {
-				c.Set("username", username)
+			c.Set("account_id", owned.AccountID)
+		}
+
+		// Closed accounts are soft deleted, tokens still carrying them stop working,
+		// and so do tokens of suspended accounts
+		var acting model.Account
+		if err := db.Select("account_id", "status").First(&acting, c.GetInt64("account_id")).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Account is closed", "code": "ACCOUNT_CLOSED"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			}
-		} else {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
+		if acting.Status == model.AccountSuspended {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is suspended", "code": "ACCOUNT_SUSPENDED"})
+			c.Abort()
+			return
+		}
+		if username, ok := claims["username"].(string); ok {
+			c.Set("username", username)
+		}
+		if role, ok := claims["role"].(string); ok {
+			c.Set("role", role)
+		}
+		if sessionID, ok := claims["sid"].(string); ok {
+			c.Set("session_id", sessionID)
+		}
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+			c.Set("token_expires_at", exp.Time)
+		}
 
 		c.Next() // Authorized, Proceed to the next handler
 	}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"task-golang-db/model"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// A key still in progress after this long belongs to a request that died, it can be claimed again
+	idempotencyClaimTimeout = 5 * time.Minute
+	// Completed keys are replayed for this long, then deleted
+	idempotencyKeyTTL = 24 * time.Hour
+)
+
+// responseRecorder keeps a copy of the response body so it can be replayed
+type responseRecorder struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
+
+// Idempotency replays the stored response when a request is retried with the same
+// Idempotency-Key header and rejects a different request sent under a used key.
+// It must run after AuthMiddleware, keys are scoped to the account_id.
+func Idempotency(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next() // No key given, nothing to protect
+			return
+		}
+
+		// Read the body and put it back for the handler
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "\n"))
+		hash.Write(body)
+
+		// Claim the key, only the first request gets to insert it
+		record := model.IdempotencyKey{
+			AccountID:   c.GetInt64("account_id"),
+			Key:         key,
+			RequestHash: hex.EncodeToString(hash.Sum(nil)),
+		}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+			return
+		}
+
+		if result.RowsAffected == 0 {
+			existing := model.IdempotencyKey{}
+			if err := db.Where("account_id = ? AND idempotency_key = ?", record.AccountID, key).
+				First(&existing).Error; err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			if existing.RequestHash != record.RequestHash {
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+					"error": "Idempotency-Key was already used for a different request",
+				})
+				return
+			}
+			if existing.StatusCode != 0 {
+				// Replay the first response
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.StatusCode, "application/json; charset=utf-8", existing.ResponseBody)
+				c.Abort()
+				return
+			}
+
+			// Take over a stale claim, only one retry can win it
+			now := time.Now()
+			reclaimed := db.Model(&model.IdempotencyKey{}).
+				Where("idempotency_key_id = ? AND status_code = 0 AND created_at < ?",
+					existing.IdempotencyKeyID, now.Add(-idempotencyClaimTimeout)).
+				Update("created_at", now)
+			if reclaimed.Error != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": reclaimed.Error.Error()})
+				return
+			}
+			if reclaimed.RowsAffected == 0 {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{
+					"error": "A request with this Idempotency-Key is still in progress",
+				})
+				return
+			}
+			record = existing
+		}
+
+		// A panicking handler rolled back its work, release the key for a retry
+		defer func() {
+			if r := recover(); r != nil {
+				db.Delete(&record)
+				panic(r)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = recorder
+
+		c.Next()
+
+		// Server errors are not stored so the client can safely retry
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			db.Delete(&record)
+			return
+		}
+
+		db.Model(&record).Updates(map[string]interface{}{
+			"status_code":   status,
+			"response_body": recorder.body.Bytes(),
+		})
+	}
+}
+
+// IdempotencyKeyCleaner deletes completed keys once they are past their TTL
+type IdempotencyKeyCleaner struct {
+	db       *gorm.DB
+	interval time.Duration
+}
+
+func NewIdempotencyKeyCleaner(db *gorm.DB, interval time.Duration) *IdempotencyKeyCleaner {
+	return &IdempotencyKeyCleaner{
+		db:       db,
+		interval: interval,
+	}
+}
+
+// Run deletes expired keys every interval until ctx is cancelled
+func (k *IdempotencyKeyCleaner) Run(ctx context.Context) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		err := k.db.Where("status_code <> 0 AND created_at < ?", time.Now().Add(-idempotencyKeyTTL)).
+			Delete(&model.IdempotencyKey{}).Error
+		if err != nil {
+			log.Println("Idempotency key cleaner:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,9 +1,42 @@
 package model
 
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Account statuses. Closing accounts wait for their holds to settle,
+// closed accounts are also soft deleted so their history is kept.
+// Frozen accounts can't send money, suspended accounts can't login.
+const (
+	AccountActive    = "active"
+	AccountClosing   = "closing"
+	AccountClosed    = "closed"
+	AccountFrozen    = "frozen"
+	AccountSuspended = "suspended"
+)
+
+// Balance is the ledger balance, HeldBalance the part of it reserved by holds.
+// Only Balance - HeldBalance is available for spending.
 type Account struct {
-	AccountID int64  `json:"account_id" gorm:"primaryKey;autoIncrement;<-:false"`
-	Name      string `json:"name"`
-	Balance   int64  `json:"balance"`
+	AccountID         int64          `json:"account_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	Name              string         `json:"name"`
+	Balance           int64          `json:"balance" gorm:"<-:false"`
+	HeldBalance       int64          `json:"held_balance" gorm:"<-:false"`
+	Currency          string         `json:"currency" gorm:"<-:create;default:IDR"`
+	SystemCode        *string        `json:"system_code,omitempty" gorm:"<-:create"`
+	ReferralCode      *string        `json:"referral_code,omitempty" gorm:"<-:create"`
+	ReferralAccountID *int64         `json:"referral_account_id,omitempty" gorm:"<-:create"`
+	OwnerAuthID       *int64         `json:"owner_auth_id,omitempty" gorm:"<-:create"`
+	Status            string         `json:"status" gorm:"<-:create;default:active"`
+	ClosedAt          *time.Time     `json:"closed_at,omitempty" gorm:"<-:create"`
+	DeletedAt         gorm.DeletedAt `json:"-"`
+}
+
+// Available returns the balance that is not reserved by holds
+func (a *Account) Available() int64 {
+	return a.Balance - a.HeldBalance
 }
 
 // func (Account) TableName() string {
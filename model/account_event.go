@@ -0,0 +1,43 @@
+package model
+
+import (
+	"encoding/json"
+
+	"gorm.io/gorm"
+)
+
+// AccountEventsChannel is the Postgres NOTIFY channel of balance and transaction changes
+const AccountEventsChannel = "account_events"
+
+// Account event types
+const (
+	AccountEventBalance     = "balance"
+	AccountEventTransaction = "transaction"
+)
+
+// AccountEvent is the payload sent on AccountEventsChannel. Balance events carry
+// no data, listeners read the committed balance.
+type AccountEvent struct {
+	AccountID int64           `json:"account_id"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// NotifyAccountEvent sends the event with pg_notify. Postgres only delivers it
+// when tx commits, so listeners never see rolled back changes.
+func NotifyAccountEvent(tx *gorm.DB, accountID int64, event string, data interface{}) error {
+	e := AccountEvent{AccountID: accountID, Event: event}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		e.Data = raw
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", AccountEventsChannel, string(payload)).Error
+}
@@ -0,0 +1,22 @@
+package model
+
+// Limit kinds
+const (
+	LimitTopup    = "topup"
+	LimitTransfer = "transfer"
+)
+
+// AccountLimit caps topups or transfers. A nil AccountID is the global default,
+// a row for an account overrides the fields it sets. Nil fields are unlimited.
+// Amounts are in Currency, accounts only use the limits of their own currency.
+type AccountLimit struct {
+	AccountLimitID    int64  `json:"account_limit_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	AccountID         *int64 `json:"account_id"`
+	Kind              string `json:"kind"`
+	Currency          string `json:"currency"`
+	PerTransactionMax *int64 `json:"per_transaction_max"`
+	DailyCount        *int64 `json:"daily_count"`
+	DailyAmount       *int64 `json:"daily_amount"`
+	MonthlyCount      *int64 `json:"monthly_count"`
+	MonthlyAmount     *int64 `json:"monthly_amount"`
+}
@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// AccountStatusChange is the history of an account's status, every change has a reason
+type AccountStatusChange struct {
+	AccountStatusChangeID int64     `json:"account_status_change_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	AccountID             int64     `json:"account_id"`
+	FromStatus            string    `json:"from_status"`
+	ToStatus              string    `json:"to_status"`
+	Reason                string    `json:"reason"`
+	ChangedBy             int64     `json:"changed_by"`
+	CreatedAt             time.Time `json:"created_at"`
+}
@@ -0,0 +1,34 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuditLog records one mutating request. Rows are only ever inserted,
+// the database rejects updates and deletes.
+type AuditLog struct {
+	AuditLogID int64           `json:"audit_log_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	RequestID  string          `json:"request_id"`
+	AuthID     *int64          `json:"auth_id,omitempty"`
+	Role       string          `json:"role,omitempty"`
+	Action     string          `json:"action"`
+	Entity     string          `json:"entity,omitempty"`
+	EntityID   string          `json:"entity_id,omitempty"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	StatusCode int             `json:"status_code"`
+	IP         string          `json:"ip"`
+	Before     json.RawMessage `json:"before,omitempty" gorm:"type:jsonb"`
+	After      json.RawMessage `json:"after,omitempty" gorm:"type:jsonb"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// AuditChange is what a handler changed, the audit middleware adds it to the request's AuditLog
+type AuditChange struct {
+	Action   string
+	Entity   string
+	EntityID string
+	Before   json.RawMessage
+	After    json.RawMessage
+}
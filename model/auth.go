@@ -1,8 +1,16 @@
 package model
 
+// Roles of a login
+const (
+	RoleUser    = "user"
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
 type Auth struct {
 	AuthID    int64 `gorm:"primaryKey;autoIncrement;<-:false"`
 	AccountID int64
 	Username  string
 	Password  string
+	Role      string `gorm:"default:user"`
 }
@@ -0,0 +1,9 @@
+package model
+
+// CategoryBudget is the monthly spending budget an account sets on a transaction category
+type CategoryBudget struct {
+	CategoryBudgetID      int64 `json:"category_budget_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	AccountID             int64 `json:"account_id"`
+	TransactionCategoryID int64 `json:"transaction_category_id"`
+	Amount                int64 `json:"amount"`
+}
@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// Credential audit actions
+const (
+	CredentialPasswordChange = "password_change"
+	CredentialAdminSet       = "admin_set"
+)
+
+// CredentialAudit records every change of a login's username or password
+type CredentialAudit struct {
+	CredentialAuditID int64     `json:"credential_audit_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	AuthID            int64     `json:"auth_id"`
+	ActorAuthID       int64     `json:"actor_auth_id"`
+	Action            string    `json:"action"`
+	Reason            string    `json:"reason"`
+	IP                string    `json:"ip" gorm:"column:ip"`
+	CreatedAt         time.Time `json:"created_at"`
+}
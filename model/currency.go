@@ -0,0 +1,34 @@
+package model
+
+import "time"
+
+// Supported currencies, amounts are always in the smallest unit of the currency
+const (
+	CurrencyIDR = "IDR"
+	CurrencyUSD = "USD"
+
+	DefaultCurrency = CurrencyIDR
+)
+
+var SupportedCurrencies = []string{CurrencyIDR, CurrencyUSD}
+
+func IsSupportedCurrency(currency string) bool {
+	for _, c := range SupportedCurrencies {
+		if c == currency {
+			return true
+		}
+	}
+	return false
+}
+
+// FxRate converts amounts from BaseCurrency to QuoteCurrency:
+// quote amount = base amount * Rate, rounded down. Rate is the exact
+// decimal, it is kept as a string so it never goes through float64.
+type FxRate struct {
+	FxRateID      int64     `json:"fx_rate_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	BaseCurrency  string    `json:"base_currency"`
+	QuoteCurrency string    `json:"quote_currency"`
+	Rate          string    `json:"rate"`
+	UpdatedBy     int64     `json:"updated_by"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
@@ -0,0 +1,38 @@
+package model
+
+import "time"
+
+// Screened operations, an internal transfer moves money between wallets of the same login
+const (
+	FraudOperationTopup            = "topup"
+	FraudOperationTransfer         = "transfer"
+	FraudOperationInternalTransfer = "internal_transfer"
+	FraudOperationTransaction      = "transaction"
+)
+
+// Review statuses, blocked operations are kept for reference only
+const (
+	FraudReviewPending  = "pending"
+	FraudReviewApproved = "approved"
+	FraudReviewRejected = "rejected"
+	FraudReviewBlocked  = "blocked"
+)
+
+// FraudReview is an operation stopped by the fraud rules. Payload is the
+// original request body, an approved review executes it.
+type FraudReview struct {
+	FraudReviewID   int64      `json:"fraud_review_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	AccountID       int64      `json:"account_id"`
+	AuthID          int64      `json:"auth_id"` // 0 for standing order runs
+	Operation       string     `json:"operation"`
+	Amount          int64      `json:"amount"`
+	TargetAccountID *int64     `json:"target_account_id,omitempty"`
+	Payload         []byte     `json:"-"`
+	Rules           string     `json:"rules"` // names of the rules that matched, comma separated
+	Status          string     `json:"status"`
+	ReviewedBy      *int64     `json:"reviewed_by,omitempty"`
+	ReviewNote      string     `json:"review_note,omitempty"`
+	TransactionID   *int64     `json:"transaction_id,omitempty"` // set when an approved review was executed
+	CreatedAt       time.Time  `json:"created_at"`
+	ReviewedAt      *time.Time `json:"reviewed_at,omitempty"`
+}
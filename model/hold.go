@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// Hold statuses
+const (
+	HoldAuthorized = "authorized"
+	HoldCaptured   = "captured"
+	HoldVoided     = "voided"
+	HoldExpired    = "expired"
+)
+
+// Hold reserves Amount of the account's balance for a later transfer to TargetAccountID,
+// plus the Fee charged when it is captured. While authorized Amount + Fee counts
+// in accounts.held_balance and can't be spent.
+type Hold struct {
+	HoldID          int64     `json:"hold_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	AccountID       int64     `json:"account_id"`
+	TargetAccountID int64     `json:"target_account_id"`
+	Amount          int64     `json:"amount"`
+	Fee             int64     `json:"fee"`
+	CapturedAmount  int64     `json:"captured_amount"`
+	Status          string    `json:"status"`
+	JournalEntryID  *int64    `json:"journal_entry_id,omitempty"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Reserved is what the hold keeps out of the available balance
+func (h Hold) Reserved() int64 {
+	return h.Amount + h.Fee
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// IdempotencyKey stores the outcome of a request sent with an Idempotency-Key header.
+// A zero StatusCode means the first request is still being processed.
+type IdempotencyKey struct {
+	IdempotencyKeyID int64 `gorm:"primaryKey;autoIncrement;<-:false"`
+	AccountID        int64
+	Key              string `gorm:"column:idempotency_key"`
+	RequestHash      string
+	StatusCode       int
+	ResponseBody     []byte
+	CreatedAt        time.Time
+}
@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// Journal entry types
+const (
+	EntryTypeTopup          = "topup"
+	EntryTypeTransfer       = "transfer"
+	EntryTypeOpeningBalance = "opening_balance"
+	EntryTypeReferralBonus  = "referral_bonus"
+	EntryTypeReversal       = "reversal"
+)
+
+// JournalEntry groups the postings of a single money movement.
+// The amounts of its postings always sum to zero in every currency.
+type JournalEntry struct {
+	JournalEntryID int64     `json:"journal_entry_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	EntryType      string    `json:"entry_type"`
+	Description    string    `json:"description"`
+	CreatedAt      time.Time `json:"created_at"`
+	Postings       []Posting `json:"postings,omitempty" gorm:"foreignKey:JournalEntryID"`
+}
+
+// Posting is one leg of a journal entry, in the currency of its account.
+// A positive amount credits the account, a negative amount debits it.
+type Posting struct {
+	PostingID      int64     `json:"posting_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	JournalEntryID int64     `json:"journal_entry_id"`
+	AccountID      int64     `json:"account_id"`
+	Amount         int64     `json:"amount"`
+	Currency       string    `json:"currency"`
+	CreatedAt      time.Time `json:"created_at"`
+}
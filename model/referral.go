@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// ReferralReward is the bonus paid once per referee, on their first topup.
+// Amount is what the referrer earned, in the referrer's currency.
+type ReferralReward struct {
+	ReferralRewardID  int64     `json:"referral_reward_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	ReferrerAccountID int64     `json:"referrer_account_id"`
+	RefereeAccountID  int64     `json:"referee_account_id"`
+	Amount            int64     `json:"amount"`
+	JournalEntryID    int64     `json:"journal_entry_id"`
+	CreatedAt         time.Time `json:"created_at"`
+}
@@ -0,0 +1,50 @@
+package model
+
+import "time"
+
+// Standing order schedules
+const (
+	ScheduleOnce    = "once"
+	ScheduleDaily   = "daily"
+	ScheduleWeekly  = "weekly"
+	ScheduleMonthly = "monthly"
+)
+
+// Standing order statuses
+const (
+	StandingOrderActive    = "active"
+	StandingOrderCompleted = "completed"
+	StandingOrderCancelled = "cancelled"
+	StandingOrderFailed    = "failed"
+)
+
+// StandingOrder is a transfer the scheduler executes at NextRunAt,
+// once or repeatedly depending on the schedule. A failed run is retried
+// at RetryAt while NextRunAt keeps the scheduled occurrence.
+type StandingOrder struct {
+	StandingOrderID int64      `json:"standing_order_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	AccountID       int64      `json:"account_id"`
+	TargetAccountID int64      `json:"target_account_id"`
+	Amount          int64      `json:"amount"`
+	Schedule        string     `json:"schedule"`
+	DayOfMonth      *int       `json:"day_of_month,omitempty"`
+	NextRunAt       time.Time  `json:"next_run_at"`
+	RetryAt         *time.Time `json:"retry_at,omitempty"`
+	Status          string     `json:"status"`
+	RetryCount      int        `json:"retry_count"`
+	LastError       *string    `json:"last_error,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// StandingOrderRun records every execution attempt of a standing order.
+// Status is success, failed or review when fraud screening held the run.
+type StandingOrderRun struct {
+	StandingOrderRunID int64     `json:"standing_order_run_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	StandingOrderID    int64     `json:"standing_order_id"`
+	ScheduledAt        time.Time `json:"scheduled_at"`
+	Attempt            int       `json:"attempt"`
+	Status             string    `json:"status"`
+	Error              *string   `json:"error,omitempty"`
+	JournalEntryID     *int64    `json:"journal_entry_id,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+}
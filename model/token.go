@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// RefreshToken is stored as a hash, the raw token is only known to the client.
+// Every rotation creates a new token in the same family and revokes the old one.
+type RefreshToken struct {
+	RefreshTokenID int64 `gorm:"primaryKey;autoIncrement;<-:false"`
+	AuthID         int64
+	FamilyID       string
+	TokenHash      string
+	ExpiresAt      time.Time
+	RevokedAt      *time.Time
+	CreatedAt      time.Time
+}
+
+// RevokedToken blocks an access token, by its jti claim, until it expires
+type RevokedToken struct {
+	Jti       string `gorm:"primaryKey"`
+	ExpiresAt time.Time
+}
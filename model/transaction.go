@@ -2,16 +2,44 @@ package model
 
 import "time"
 
+// Transaction types
+const (
+	TransactionTypeTopup       = "topup"
+	TransactionTypeTransferOut = "transfer_out"
+	TransactionTypeTransferIn  = "transfer_in"
+	TransactionTypeFee         = "fee"
+	TransactionTypeManual      = "manual"
+	TransactionTypeOpening     = "opening_balance"
+	TransactionTypeReferral    = "referral_bonus"
+	TransactionTypeInternalOut = "internal_out"
+	TransactionTypeInternalIn  = "internal_in"
+	TransactionTypeReversal    = "reversal"
+	TransactionTypePayoutOut   = "closure_payout_out"
+	TransactionTypePayoutIn    = "closure_payout_in"
+)
+
+// FxRate, CounterAmount and CounterCurrency are set on both legs of a
+// cross-currency transfer: the rate used and the amount on the other side.
+// A reversal points at the transaction it compensates with ReversalOfID,
+// ReversedAmount is only filled in history listings.
 type Transaction struct {
-    TransactionID         int64      `json:"transaction_id" db:"transaction_id" gorm:"primaryKey;autoIncrement"`
-    TransactionCategoryID *int64     `json:"transaction_category_id,omitempty" db:"transaction_category_id"`
-    AccountID             int64      `json:"account_id" db:"account_id"`
-    FromAccountID         *int64     `json:"from_account_id,omitempty" db:"from_account_id"`
-    ToAccountID           *int64     `json:"to_account_id,omitempty" db:"to_account_id"`
-    Amount                int64      `json:"amount" db:"amount"`
-    TransactionDate       time.Time  `json:"transaction_date" db:"transaction_date"`
+	TransactionID         int64     `json:"transaction_id" db:"transaction_id" gorm:"primaryKey;autoIncrement"`
+	TransactionCategoryID *int64    `json:"transaction_category_id,omitempty" db:"transaction_category_id"`
+	AccountID             int64     `json:"account_id" db:"account_id"`
+	FromAccountID         *int64    `json:"from_account_id,omitempty" db:"from_account_id"`
+	ToAccountID           *int64    `json:"to_account_id,omitempty" db:"to_account_id"`
+	Amount                int64     `json:"amount" db:"amount"`
+	TransactionDate       time.Time `json:"transaction_date" db:"transaction_date"`
+	TransactionType       string    `json:"transaction_type" db:"transaction_type"`
+	JournalEntryID        *int64    `json:"journal_entry_id,omitempty" db:"journal_entry_id"`
+	Currency              string    `json:"currency,omitempty" db:"currency"`
+	FxRate                *string   `json:"fx_rate,omitempty" db:"fx_rate"`
+	CounterAmount         *int64    `json:"counter_amount,omitempty" db:"counter_amount"`
+	CounterCurrency       *string   `json:"counter_currency,omitempty" db:"counter_currency"`
+	ReversalOfID          *int64    `json:"reversal_of_id,omitempty" db:"reversal_of_id"`
+	ReversedAmount        int64     `json:"reversed_amount,omitempty" gorm:"-"`
 }
 
 func (Transaction) TableName() string {
-    return "transaction"
-}
\ No newline at end of file
+	return "transaction"
+}
@@ -1,6 +1,8 @@
 package model
 
 type TransactionCategory struct {
-    ID   int64  `json:"id" db:"id"`
-    Name string `json:"name" db:"name"`
+	ID   int64  `json:"id" db:"transaction_category_id" gorm:"column:transaction_category_id;primaryKey;autoIncrement;<-:false"`
+	Name string `json:"name" db:"name"`
+	// AccountID is the owner, nil for the global default categories
+	AccountID *int64 `json:"account_id" db:"account_id" gorm:"<-:create"`
 }
@@ -0,0 +1,65 @@
+package model
+
+import "time"
+
+// Webhook event types
+const (
+	EventTopupCompleted   = "topup.completed"
+	EventTransferSent     = "transfer.sent"
+	EventTransferReceived = "transfer.received"
+)
+
+var WebhookEventTypes = []string{EventTopupCompleted, EventTransferSent, EventTransferReceived}
+
+// Webhook delivery statuses
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookSubscription receives the events listed in EventTypes, comma separated.
+// A nil AccountID subscribes to the events of every account.
+type WebhookSubscription struct {
+	WebhookSubscriptionID int64     `json:"webhook_subscription_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	URL                   string    `json:"url"`
+	Secret                string    `json:"-"`
+	EventTypes            string    `json:"event_types"`
+	AccountID             *int64    `json:"account_id,omitempty"`
+	Active                bool      `json:"active"`
+	CreatedBy             int64     `json:"created_by"`
+	CreatedAt             time.Time `json:"created_at"`
+}
+
+// WebhookEvent is the outbox, written in the same DB transaction as the change it announces.
+// The dispatcher creates a delivery per matching subscription and sets DispatchedAt.
+type WebhookEvent struct {
+	WebhookEventID int64      `json:"webhook_event_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	EventType      string     `json:"event_type"`
+	AccountID      int64      `json:"account_id"`
+	Payload        []byte     `json:"-"`
+	DispatchedAt   *time.Time `json:"dispatched_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// WebhookDelivery sends one event to one subscription, retried until NextAttemptAt gives up
+type WebhookDelivery struct {
+	WebhookDeliveryID     int64      `json:"webhook_delivery_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	WebhookEventID        int64      `json:"webhook_event_id"`
+	WebhookSubscriptionID int64      `json:"webhook_subscription_id"`
+	Status                string     `json:"status"`
+	Attempts              int        `json:"attempts"`
+	NextAttemptAt         time.Time  `json:"next_attempt_at"`
+	DeliveredAt           *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
+}
+
+// WebhookAttempt logs one HTTP request of a delivery
+type WebhookAttempt struct {
+	WebhookAttemptID  int64     `json:"webhook_attempt_id" gorm:"primaryKey;autoIncrement;<-:false"`
+	WebhookDeliveryID int64     `json:"webhook_delivery_id"`
+	StatusCode        *int      `json:"status_code,omitempty"`
+	Error             *string   `json:"error,omitempty"`
+	DurationMs        int64     `json:"duration_ms"`
+	AttemptedAt       time.Time `json:"attempted_at"`
+}